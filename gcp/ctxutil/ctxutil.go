@@ -0,0 +1,99 @@
+// Package ctxutil derives per-operation contexts for the Bigtable and
+// BigQuery examples, so deadline policy lives in one place instead of in
+// ad-hoc context.WithTimeout calls scattered through the code.
+//
+// Operations are dotted names such as "bigquery.query.gaps". A timeout set
+// for "bigquery.query" applies to every query that has no more specific
+// entry, so callers can name operations precisely for logging without
+// having to configure each one.
+package ctxutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	mu       sync.RWMutex
+	timeouts = map[string]time.Duration{}
+)
+
+// SetTimeout sets the deadline for op and the operations below it. Zero or
+// less removes the entry, so op falls back to its parent's timeout; with no
+// entry at any level an operation has no deadline of its own.
+func SetTimeout(op string, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	if d <= 0 {
+		delete(timeouts, op)
+		return
+	}
+	timeouts[op] = d
+}
+
+// Timeout returns the deadline that applies to op, walking up its dotted
+// name until an entry is found, or 0 if there is none.
+func Timeout(op string) time.Duration {
+	mu.RLock()
+	defer mu.RUnlock()
+	for name := op; name != ""; {
+		if d, ok := timeouts[name]; ok {
+			return d
+		}
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return 0
+}
+
+type opKey struct{}
+
+type opInfo struct {
+	name    string
+	timeout time.Duration
+}
+
+// WithOperationTimeout derives a context for one operation from parent,
+// bounded by op's configured timeout (a shorter deadline already on parent
+// still wins) and carrying op's name for Operation and Wrap. Always call
+// the returned cancel function.
+func WithOperationTimeout(parent context.Context, op string) (context.Context, context.CancelFunc) {
+	d := Timeout(op)
+	ctx := context.WithValue(parent, opKey{}, opInfo{name: op, timeout: d})
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// Operation returns the name of the innermost operation ctx was derived
+// for, or "" if none.
+func Operation(ctx context.Context) string {
+	info, _ := ctx.Value(opKey{}).(opInfo)
+	return info.name
+}
+
+// Wrap annotates err with the operation's name when ctx's deadline expired,
+// so a timeout reads "bigquery.query.gaps: timed out after 5m0s: ..."
+// rather than a bare "context deadline exceeded". Other errors and nil are
+// returned unchanged.
+func Wrap(ctx context.Context, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	info, ok := ctx.Value(opKey{}).(opInfo)
+	if !ok {
+		return err
+	}
+	if info.timeout > 0 {
+		return fmt.Errorf("%s: timed out after %v: %w", info.name, info.timeout, err)
+	}
+	return fmt.Errorf("%s: %w", info.name, err)
+}
@@ -0,0 +1,63 @@
+// Package device defines the sensor identifier shared by the Bigtable and
+// BigQuery examples.
+//
+// Bigtable row keys are built as deviceID#reversedMillis, so an ID that
+// contains '#' would make its keys ambiguous with another device's and
+// break prefix scans. Validating IDs once, when they enter the program,
+// keeps that from happening anywhere downstream.
+package device
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxIDLen is the longest accepted ID in bytes. It keeps row keys well under
+// Bigtable's recommended 4 KB and BigQuery clustering keys short.
+const MaxIDLen = 64
+
+// ErrInvalidID is wrapped by every error NewID returns.
+var ErrInvalidID = errors.New("invalid device ID")
+
+// ID identifies a sensor. Obtain one from NewID so it is known to be
+// non-empty, at most MaxIDLen bytes and made of ASCII letters, digits,
+// '-', '_' and '.'; in particular it never contains the '#' row-key
+// separator.
+type ID string
+
+// NewID validates s and returns it as an ID.
+func NewID(s string) (ID, error) {
+	if s == "" {
+		return "", fmt.Errorf("%w: empty", ErrInvalidID)
+	}
+	if len(s) > MaxIDLen {
+		return "", fmt.Errorf("%w: %d bytes, max %d", ErrInvalidID, len(s), MaxIDLen)
+	}
+	for i := 0; i < len(s); i++ {
+		if !validByte(s[i]) {
+			return "", fmt.Errorf("%w: %q has disallowed character %q at %d", ErrInvalidID, s, s[i], i)
+		}
+	}
+	return ID(s), nil
+}
+
+// MustNewID is like NewID but panics on an invalid ID. Use it for constants.
+func MustNewID(s string) ID {
+	id, err := NewID(s)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (id ID) String() string { return string(id) }
+
+func validByte(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	case c == '-', c == '_', c == '.':
+		return true
+	}
+	return false
+}
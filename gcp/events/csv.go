@@ -0,0 +1,114 @@
+package events
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+
+	"tidy/device"
+)
+
+// CSVFlushEvery is how many rows a CSVSink buffers between flushes.
+const CSVFlushEvery = 1000
+
+// CSVHeader is the first record a CSVSink writes.
+var CSVHeader = []string{"event_id", "device_id", "timestamp", "temperature"}
+
+// CSVSink writes rows as CSV with a header, flushing every CSVFlushEvery
+// rows. NULL temperatures are written as empty fields. ParseCSVRecord
+// reads this format back.
+type CSVSink struct {
+	bw     *bufio.Writer
+	cw     *csv.Writer
+	record []string
+	n      int
+	header bool
+}
+
+// NewCSVSink returns a CSVSink writing to w through a 64 KB buffer.
+func NewCSVSink(w io.Writer) *CSVSink {
+	bw := bufio.NewWriterSize(w, 64*1024)
+	return &CSVSink{bw: bw, cw: csv.NewWriter(bw), record: make([]string, len(CSVHeader))}
+}
+
+// writeHeader writes the header once, so even an empty export has one.
+func (s *CSVSink) writeHeader() error {
+	if s.header {
+		return nil
+	}
+	s.header = true
+	if err := s.cw.Write(CSVHeader); err != nil {
+		return fmt.Errorf("csv.Write: %w", err)
+	}
+	return nil
+}
+
+func (s *CSVSink) Write(row Row) error {
+	if err := s.writeHeader(); err != nil {
+		return err
+	}
+
+	s.record[0] = row.EventID
+	s.record[1] = string(row.DeviceID)
+	s.record[2] = row.Timestamp.UTC().Format(time.RFC3339Nano)
+	s.record[3] = ""
+	if row.Temperature.Valid {
+		s.record[3] = strconv.FormatFloat(row.Temperature.Float64, 'f', -1, 64)
+	}
+	if err := s.cw.Write(s.record); err != nil {
+		return fmt.Errorf("csv.Write: %w", err)
+	}
+
+	s.n++
+	if s.n%CSVFlushEvery == 0 {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *CSVSink) flush() error {
+	s.cw.Flush()
+	if err := s.cw.Error(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	if err := s.bw.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	return nil
+}
+
+func (s *CSVSink) Close() error {
+	if err := s.writeHeader(); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+// ParseCSVRecord is the inverse of the record CSVSink writes for a row.
+func ParseCSVRecord(rec []string) (Row, error) {
+	if len(rec) != len(CSVHeader) {
+		return Row{}, fmt.Errorf("got %d fields, want %d", len(rec), len(CSVHeader))
+	}
+	id, err := device.NewID(rec[1])
+	if err != nil {
+		return Row{}, err
+	}
+	ts, err := time.Parse(time.RFC3339Nano, rec[2])
+	if err != nil {
+		return Row{}, fmt.Errorf("timestamp: %w", err)
+	}
+	row := Row{EventID: rec[0], DeviceID: id, Timestamp: ts}
+	if rec[3] != "" {
+		t, err := strconv.ParseFloat(rec[3], 64)
+		if err != nil {
+			return Row{}, fmt.Errorf("temperature: %w", err)
+		}
+		row.Temperature = bigquery.NullFloat64{Float64: t, Valid: true}
+	}
+	return row, nil
+}
@@ -0,0 +1,140 @@
+package events
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+
+	"tidy/device"
+)
+
+// fakeIterator yields n synthetic rows, calling check (if set) before
+// every row so a test can look at the state mid-export.
+type fakeIterator struct {
+	n, i  int
+	check func(i int)
+}
+
+func (it *fakeIterator) Next(dst interface{}) error {
+	if it.i == it.n {
+		return iterator.Done
+	}
+	if it.check != nil {
+		it.check(it.i)
+	}
+	row := Row{
+		EventID:   fmt.Sprintf("evt-%09d", it.i),
+		DeviceID:  device.MustNewID(fmt.Sprintf("sensor-%d", it.i%100)),
+		Timestamp: time.Unix(1700000000, 0).Add(time.Duration(it.i) * time.Second),
+	}
+	if it.i%7 != 0 { // every 7th temperature is NULL
+		row.Temperature = bigquery.NullFloat64{Float64: 20 + float64(it.i%100)/10, Valid: true}
+	}
+	*dst.(*Row) = row
+	it.i++
+	return nil
+}
+
+// countingWriter discards what it is given and counts the bytes.
+type countingWriter struct{ n int }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+func TestCopyCSVMemoryStaysFlat(t *testing.T) {
+	const rows = 500_000 // about 30 MB of CSV
+	const checkEvery = 100_000
+
+	out := &countingWriter{}
+	var heap []uint64
+	var written []int
+	it := &fakeIterator{n: rows, check: func(i int) {
+		if i == 0 || i%checkEvery != 0 {
+			return
+		}
+		runtime.GC()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		heap = append(heap, ms.HeapAlloc)
+		written = append(written, out.n)
+	}}
+
+	sink := NewCSVSink(out)
+	n, err := Copy(it, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != rows {
+		t.Fatalf("Copy = %d rows, want %d", n, rows)
+	}
+
+	// Rows must leave for the writer as they arrive, not at Close.
+	for i := 1; i < len(written); i++ {
+		if written[i] <= written[i-1] {
+			t.Errorf("no output between checkpoints %d and %d: %d bytes", i-1, i, written[i])
+		}
+	}
+	// And nothing may pile up: the live heap is the same at every checkpoint.
+	const slack = 1 << 20
+	lo, hi := heap[0], heap[0]
+	for _, h := range heap {
+		lo, hi = min(lo, h), max(hi, h)
+	}
+	if hi-lo > slack {
+		t.Errorf("live heap grew from %d to %d bytes while writing %d bytes of CSV", lo, hi, out.n)
+	}
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	it := &fakeIterator{n: 20}
+	sink := NewCSVSink(&buf)
+	if _, err := Copy(it, sink); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 21 {
+		t.Fatalf("got %d records, want header + 20", len(recs))
+	}
+
+	want := &fakeIterator{n: 20}
+	for i, rec := range recs[1:] {
+		got, err := ParseCSVRecord(rec)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		var w Row
+		want.Next(&w)
+		if got.EventID != w.EventID || got.DeviceID != w.DeviceID || !got.Timestamp.Equal(w.Timestamp) || got.Temperature != w.Temperature {
+			t.Errorf("record %d = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestCSVEmptyHasHeader(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewCSVSink(&buf).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "event_id,device_id,timestamp,temperature\n"; got != want {
+		t.Errorf("empty export = %q, want %q", got, want)
+	}
+}
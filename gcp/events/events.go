@@ -0,0 +1,66 @@
+// Package events defines the row of the BigQuery events table and the
+// plumbing that streams rows from a query iterator to an output, kept out
+// of the BigQuery example so it can be tested on its own.
+package events
+
+import (
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+
+	"tidy/device"
+)
+
+// Row models a row of the events table.
+//
+// The bigquery tag sets the column name. Reserved words such as "timestamp"
+// or "order" are fine as tags (only SQL needs them backquoted), and columns
+// are matched to fields ignoring case. What a tag cannot express is a name
+// outside [A-Za-z_][A-Za-z0-9_]*, e.g. the flexible column name "temp-c":
+// the client rejects such tags, so alias the column in SQL instead
+// (SELECT `temp-c` AS temp_c). Columns with no matching field are silently
+// dropped when loading rows, which is why query results should be checked
+// against Schema first. TestTagMapping pins these rules down.
+type Row struct {
+	EventID     string               `bigquery:"event_id"`
+	DeviceID    device.ID            `bigquery:"device_id"`
+	Timestamp   time.Time            `bigquery:"timestamp"`
+	Temperature bigquery.NullFloat64 `bigquery:"temperature"` // Use BigQuery's null type
+}
+
+// Iterator is the part of *bigquery.RowIterator Copy needs, so a fake
+// iterator can stand in for a query.
+type Iterator interface {
+	Next(dst interface{}) error
+}
+
+// Sink receives query results one row at a time, decoupling the query
+// runners from where rows end up. Close flushes buffered output; it does
+// not close any writer the sink was built on.
+type Sink interface {
+	Write(Row) error
+	Close() error
+}
+
+// Copy writes every row from it to sink and returns how many it wrote.
+// Rows go straight from the iterator to the sink, so with a streaming sink
+// such as CSVSink memory use stays flat however many rows there are.
+func Copy(it Iterator, sink Sink) (int, error) {
+	n := 0
+	for {
+		var row Row
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("iterator.Next: %w", err)
+		}
+		if err := sink.Write(row); err != nil {
+			return n, fmt.Errorf("sink.Write: %w", err)
+		}
+		n++
+	}
+}
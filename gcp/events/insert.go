@@ -0,0 +1,82 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+
+	"tidy/ctxutil"
+)
+
+// Saver wraps row for bigquery.Inserter.Put with its EventID as the
+// InsertID, so a row streamed again (a retry, a replay) is dropped by
+// BigQuery instead of stored twice.
+//
+// Streaming dedup is best-effort: BigQuery remembers InsertIDs for at least
+// one minute, so retries within that window are dropped, but duplicates can
+// still appear across longer gaps or rare backend events. Use MERGE or the
+// Storage Write API when exactly-once is a hard requirement.
+func Saver(row Row) *bigquery.StructSaver {
+	return &bigquery.StructSaver{Struct: row, InsertID: row.EventID}
+}
+
+// Count returns how many rows in the table named by the backquoted
+// tableRef have the given event_id.
+func Count(ctx context.Context, client *bigquery.Client, tableRef, eventID string) (int64, error) {
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigquery.query.count_event")
+	defer cancel()
+
+	q := client.Query(fmt.Sprintf(
+		"SELECT COUNT(*) AS n FROM %s WHERE event_id = @event_id", tableRef))
+	q.Parameters = []bigquery.QueryParameter{{Name: "event_id", Value: eventID}}
+
+	it, err := q.Read(ctx)
+	if err != nil {
+		return 0, ctxutil.Wrap(ctx, fmt.Errorf("query.Read: %w", err))
+	}
+	var row struct {
+		N int64 `bigquery:"n"`
+	}
+	if err := it.Next(&row); err != nil {
+		return 0, ctxutil.Wrap(ctx, fmt.Errorf("iterator.Next: %w", err))
+	}
+	return row.N, nil
+}
+
+// waitInterval is how often WaitForRow re-runs its COUNT query.
+const waitInterval = time.Second
+
+// WaitForRow polls until a row with eventID is visible to queries on the
+// table named by the backquoted tableRef, or until timeout elapses.
+//
+// A successful streaming insert does not mean the row is immediately
+// visible: it lands in the streaming buffer first, and queries run right
+// after the insert can miss it for a few seconds. Insert-then-read checks
+// should wait here instead of sleeping a fixed time or reading once.
+// Table metadata (NumRows) and copy/export jobs ignore the buffer for much
+// longer, up to about 90 minutes; this only covers queries.
+func WaitForRow(ctx context.Context, client *bigquery.Client, tableRef, eventID string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(waitInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := Count(ctx, client, tableRef, eventID)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if n > 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("event %s not visible in %s after %v: %w", eventID, tableRef, timeout, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
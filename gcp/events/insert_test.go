@@ -0,0 +1,94 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+
+	"tidy/device"
+	"tidy/gcpauth"
+)
+
+// testOptions returns PROJECT_ID and client options for it, skipping the
+// test when the project or credentials are missing. Other auth failures,
+// such as a bad CREDENTIALS_FILE, fail it.
+func testOptions(t testing.TB) (string, []option.ClientOption) {
+	t.Helper()
+	project := os.Getenv("PROJECT_ID")
+	if project == "" {
+		t.Skip("PROJECT_ID not set")
+	}
+	opts, err := gcpauth.ClientOptions(context.Background(), gcpauth.FromEnv())
+	if errors.Is(err, gcpauth.ErrNoCredentials) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return project, opts
+}
+
+// testClient returns a BigQuery client for PROJECT_ID, skipping like
+// testOptions.
+func testClient(t testing.TB) *bigquery.Client {
+	t.Helper()
+	project, opts := testOptions(t)
+	client, err := bigquery.NewClient(context.Background(), project, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Location = os.Getenv("BIG_QUERY_LOCATION")
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// testTable returns the backquoted events table named by
+// BIG_QUERY_DATASET_ID and BIG_QUERY_TABLE_ID, skipping if either is unset.
+func testTable(t testing.TB, client *bigquery.Client) (*bigquery.Table, string) {
+	t.Helper()
+	datasetID, tableID := os.Getenv("BIG_QUERY_DATASET_ID"), os.Getenv("BIG_QUERY_TABLE_ID")
+	if datasetID == "" || tableID == "" {
+		t.Skip("BIG_QUERY_DATASET_ID or BIG_QUERY_TABLE_ID not set")
+	}
+	return client.Dataset(datasetID).Table(tableID),
+		fmt.Sprintf("`%s.%s.%s`", client.Project(), datasetID, tableID)
+}
+
+// TestInsertIDDedup streams one row twice with the same InsertID and
+// expects a single copy. It needs a real events table and leaves its row
+// behind.
+func TestInsertIDDedup(t *testing.T) {
+	client := testClient(t)
+	tbl, tableRef := testTable(t, client)
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	row := Row{
+		EventID:     fmt.Sprintf("dedup-%d", now.UnixNano()),
+		DeviceID:    device.MustNewID("device-dedup"),
+		Timestamp:   now,
+		Temperature: bigquery.NullFloat64{Float64: 20, Valid: true},
+	}
+	for i := 0; i < 2; i++ {
+		if err := tbl.Inserter().Put(ctx, Saver(row)); err != nil {
+			t.Fatalf("insert %d: %v", i+1, err)
+		}
+	}
+	if err := WaitForRow(ctx, client, tableRef, row.EventID, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := Count(ctx, client, tableRef, row.EventID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("event %s: got %d rows after duplicate insert, want 1", row.EventID, n)
+	}
+}
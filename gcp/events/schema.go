@@ -0,0 +1,67 @@
+package events
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Schema is the events table schema: the single definition used to create
+// the table, validate query results and build Storage Write API
+// descriptors. It must stay in step with Row; CheckSchema fails if the two
+// drift apart.
+var Schema = bigquery.Schema{
+	{Name: "event_id", Type: bigquery.StringFieldType, Required: true, Description: "Unique event ID; doubles as the streaming InsertID"},
+	{Name: "device_id", Type: bigquery.StringFieldType, Required: true, Description: "Sensor that produced the event"},
+	{Name: "timestamp", Type: bigquery.TimestampFieldType, Required: true, Description: "When the event was observed (UTC)"},
+	{Name: "temperature", Type: bigquery.FloatFieldType, Description: "Degrees Celsius; NULL when the sensor reported none"},
+}
+
+// CheckSchema verifies that Schema matches the schema inferred from Row's
+// struct tags, including which columns are REQUIRED.
+func CheckSchema() error {
+	inferred, err := bigquery.InferSchema(Row{})
+	if err != nil {
+		return fmt.Errorf("bigquery.InferSchema: %w", err)
+	}
+
+	problems := SchemaProblems(Schema, inferred)
+	for _, w := range Schema {
+		for _, g := range inferred {
+			if g.Name == w.Name && g.Required != w.Required {
+				problems = append(problems, fmt.Sprintf("column %q required=%t, Row has %t", w.Name, w.Required, g.Required))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("events.Schema does not match events.Row: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// SchemaProblems lists missing, unexpected and mistyped columns in got.
+func SchemaProblems(want, got bigquery.Schema) []string {
+	gotByName := make(map[string]*bigquery.FieldSchema, len(got))
+	for _, f := range got {
+		gotByName[f.Name] = f
+	}
+
+	var problems []string
+	for _, w := range want {
+		g, ok := gotByName[w.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("missing column %q", w.Name))
+			continue
+		}
+		if g.Type != w.Type {
+			problems = append(problems, fmt.Sprintf("column %q is %s, want %s", w.Name, g.Type, w.Type))
+		}
+		delete(gotByName, w.Name)
+	}
+	for name := range gotByName {
+		problems = append(problems, fmt.Sprintf("unexpected column %q", name))
+	}
+	return problems
+}
@@ -0,0 +1,40 @@
+package events
+
+import (
+	"slices"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestSchemaMatchesRow(t *testing.T) {
+	if err := CheckSchema(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchemaProblems(t *testing.T) {
+	want := bigquery.Schema{
+		{Name: "a", Type: bigquery.StringFieldType},
+		{Name: "b", Type: bigquery.IntegerFieldType},
+		{Name: "c", Type: bigquery.FloatFieldType},
+	}
+	got := bigquery.Schema{
+		{Name: "a", Type: bigquery.StringFieldType},
+		{Name: "b", Type: bigquery.StringFieldType},
+		{Name: "d", Type: bigquery.FloatFieldType},
+	}
+	problems := SchemaProblems(want, got)
+	slices.Sort(problems)
+	wantProblems := []string{
+		`column "b" is STRING, want INTEGER`,
+		`missing column "c"`,
+		`unexpected column "d"`,
+	}
+	if !slices.Equal(problems, wantProblems) {
+		t.Errorf("SchemaProblems = %q, want %q", problems, wantProblems)
+	}
+	if p := SchemaProblems(Schema, Schema); len(p) != 0 {
+		t.Errorf("SchemaProblems(Schema, Schema) = %q, want none", p)
+	}
+}
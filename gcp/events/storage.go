@@ -0,0 +1,144 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	bqstorage "cloud.google.com/go/bigquery/storage/apiv1"
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/ipc"
+	"golang.org/x/sync/errgroup"
+
+	"tidy/device"
+)
+
+// ReadStreams caps how many streams a read session opened by
+// OpenReadSession has. BigQuery may hand back fewer for small tables.
+const ReadStreams = 4
+
+// OpenReadSession creates a Storage Read API session that reads the
+// events columns of a table as Arrow, split into at most ReadStreams
+// streams.
+func OpenReadSession(ctx context.Context, client *bqstorage.BigQueryReadClient, projectID, datasetID, tableID string) (*storagepb.ReadSession, error) {
+	session, err := client.CreateReadSession(ctx, &storagepb.CreateReadSessionRequest{
+		Parent: "projects/" + projectID,
+		ReadSession: &storagepb.ReadSession{
+			Table:      fmt.Sprintf("projects/%s/datasets/%s/tables/%s", projectID, datasetID, tableID),
+			DataFormat: storagepb.DataFormat_ARROW,
+			ReadOptions: &storagepb.ReadSession_TableReadOptions{
+				SelectedFields: []string{"event_id", "device_id", "timestamp", "temperature"},
+			},
+		},
+		MaxStreamCount: ReadStreams,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CreateReadSession: %w", err)
+	}
+	return session, nil
+}
+
+// ReadSession reads every stream of session concurrently and returns the
+// decoded rows. Row order across streams is not defined.
+//
+// At most limit rows are returned, or all of them if limit is 0; if the
+// session had more, truncated is set and the remaining streams are
+// abandoned.
+func ReadSession(ctx context.Context, client *bqstorage.BigQueryReadClient, session *storagepb.ReadSession, limit int) (rows []Row, truncated bool, err error) {
+	schema := session.GetArrowSchema().GetSerializedSchema()
+
+	errLimitReached := errors.New("row limit reached")
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	for _, s := range session.GetStreams() {
+		name := s.GetName()
+		g.Go(func() error {
+			stream, err := client.ReadRows(gctx, &storagepb.ReadRowsRequest{ReadStream: name})
+			if err != nil {
+				return fmt.Errorf("ReadRows %s: %w", name, err)
+			}
+			for {
+				resp, err := stream.Recv()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("ReadRows %s: %w", name, err)
+				}
+				batch, err := decodeArrow(schema, resp.GetArrowRecordBatch().GetSerializedRecordBatch())
+				if err != nil {
+					return fmt.Errorf("decode %s: %w", name, err)
+				}
+				mu.Lock()
+				full := limit > 0 && len(rows)+len(batch) > limit
+				if full {
+					rows = append(rows, batch[:limit-len(rows)]...)
+					truncated = true
+				} else {
+					rows = append(rows, batch...)
+				}
+				mu.Unlock()
+				if full {
+					return errLimitReached // cancels the other streams
+				}
+			}
+		})
+	}
+	if err := g.Wait(); err != nil && !errors.Is(err, errLimitReached) {
+		return nil, false, err
+	}
+	return rows, truncated, nil
+}
+
+// decodeArrow decodes one serialized Arrow record batch into Rows. The
+// Read API sends the schema once per session, so it is prepended to each
+// batch to form a complete IPC stream.
+func decodeArrow(schema, batch []byte) ([]Row, error) {
+	r, err := ipc.NewReader(io.MultiReader(bytes.NewReader(schema), bytes.NewReader(batch)))
+	if err != nil {
+		return nil, fmt.Errorf("ipc.NewReader: %w", err)
+	}
+	defer r.Release()
+
+	var rows []Row
+	for r.Next() {
+		rec := r.Record()
+		col := func(name string) arrow.Array {
+			if idx := rec.Schema().FieldIndices(name); len(idx) > 0 {
+				return rec.Column(idx[0])
+			}
+			return nil
+		}
+		ids, ok1 := col("event_id").(*array.String)
+		devices, ok2 := col("device_id").(*array.String)
+		stamps, ok3 := col("timestamp").(*array.Timestamp)
+		temps, ok4 := col("temperature").(*array.Float64)
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			return nil, fmt.Errorf("unexpected Arrow schema: %s", rec.Schema())
+		}
+		unit := stamps.DataType().(*arrow.TimestampType).Unit
+
+		// IDs are trusted as stored; they were validated when written.
+		for i := 0; i < int(rec.NumRows()); i++ {
+			row := Row{
+				EventID:   ids.Value(i),
+				DeviceID:  device.ID(devices.Value(i)),
+				Timestamp: stamps.Value(i).ToTime(unit),
+			}
+			if temps.IsValid(i) {
+				row.Temperature = bigquery.NullFloat64{Float64: temps.Value(i), Valid: true}
+			}
+			rows = append(rows, row)
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("read Arrow batch: %w", err)
+	}
+	return rows, nil
+}
@@ -0,0 +1,71 @@
+package events
+
+import (
+	"context"
+	"testing"
+
+	bqstorage "cloud.google.com/go/bigquery/storage/apiv1"
+	"google.golang.org/api/iterator"
+)
+
+// benchRows caps how many rows each read benchmark iteration reads, so a
+// large events table does not make one iteration take minutes.
+const benchRows = 100_000
+
+// The read benchmarks read the same rows of the events table through the
+// tabledata.list RowIterator and through the Storage Read API, reporting
+// rows/s next to the wall time per read (ns/op). The iterator pages JSON
+// over REST one request at a time; the Storage Read API streams Arrow over
+// several gRPC streams in parallel, so it pulls ahead as tables grow, while
+// for a few thousand rows its session setup can make it the slower of the
+// two. They need the same environment as TestInsertIDDedup:
+//
+//	go test ./events -run '^$' -bench Read -benchtime 3x
+
+func BenchmarkReadRowIterator(b *testing.B) {
+	client := testClient(b)
+	tbl, _ := testTable(b, client)
+	ctx := context.Background()
+
+	rows := 0
+	for b.Loop() {
+		it := tbl.Read(ctx)
+		for n := 0; n < benchRows; n++ {
+			var row Row
+			err := it.Next(&row)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			rows++
+		}
+	}
+	b.ReportMetric(float64(rows)/b.Elapsed().Seconds(), "rows/s")
+}
+
+func BenchmarkReadStorageAPI(b *testing.B) {
+	_, opts := testOptions(b)
+	tbl, _ := testTable(b, testClient(b))
+	ctx := context.Background()
+	client, err := bqstorage.NewBigQueryReadClient(ctx, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	rows := 0
+	for b.Loop() {
+		session, err := OpenReadSession(ctx, client, tbl.ProjectID, tbl.DatasetID, tbl.TableID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		got, _, err := ReadSession(ctx, client, session, benchRows)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rows += len(got)
+	}
+	b.ReportMetric(float64(rows)/b.Elapsed().Seconds(), "rows/s")
+}
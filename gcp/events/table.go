@@ -0,0 +1,31 @@
+package events
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// idPattern matches dataset and table IDs that are safe to quote.
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidID reports whether id is a dataset or table ID that can be spliced
+// into SQL between backquotes. Identifiers can't be query parameters, so
+// every ID that reaches SQL text from configuration or flags must pass
+// this first.
+func ValidID(id string) bool {
+	return idPattern.MatchString(id)
+}
+
+// SplitTable splits a "dataset.table" name into its IDs and checks both
+// with ValidID.
+func SplitTable(name string) (datasetID, tableID string, err error) {
+	datasetID, tableID, ok := strings.Cut(name, ".")
+	if !ok {
+		return "", "", fmt.Errorf("table must be dataset.table, got %q", name)
+	}
+	if !ValidID(datasetID) || !ValidID(tableID) {
+		return "", "", fmt.Errorf("invalid table %q", name)
+	}
+	return datasetID, tableID, nil
+}
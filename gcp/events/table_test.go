@@ -0,0 +1,29 @@
+package events
+
+import "testing"
+
+func TestSplitTable(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		dataset, table string
+		ok             bool
+	}{
+		{"sensors.events", "sensors", "events", true},
+		{"my-data.events_2024", "my-data", "events_2024", true},
+		{"events", "", "", false},
+		{".events", "", "", false},
+		{"sensors.", "", "", false},
+		{"sensors.a.b", "", "", false},
+		{"sensors.events` WHERE TRUE --", "", "", false},
+		{"sensors`.events", "", "", false},
+	} {
+		dataset, table, err := SplitTable(tc.name)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("SplitTable(%q) error = %v, want ok = %t", tc.name, err, tc.ok)
+			continue
+		}
+		if dataset != tc.dataset || table != tc.table {
+			t.Errorf("SplitTable(%q) = %q, %q, want %q, %q", tc.name, dataset, table, tc.dataset, tc.table)
+		}
+	}
+}
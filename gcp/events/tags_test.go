@@ -0,0 +1,42 @@
+package events
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// reservedNamesRow tags fields with reserved words as column names.
+type reservedNamesRow struct {
+	Timestamp time.Time `bigquery:"timestamp"`
+	Order     int64     `bigquery:"order"`
+}
+
+// flexibleNameRow tags a field with a flexible column name, which the
+// client does not support.
+type flexibleNameRow struct {
+	TempC float64 `bigquery:"temp-c"`
+}
+
+// TestTagMapping checks the struct-tag rules described on Row: reserved
+// words survive as column names unchanged, and a tag that is not a plain
+// identifier is rejected rather than mismapped.
+func TestTagMapping(t *testing.T) {
+	schema, err := bigquery.InferSchema(reservedNamesRow{})
+	if err != nil {
+		t.Fatalf("reserved names: bigquery.InferSchema: %v", err)
+	}
+	want := bigquery.Schema{
+		{Name: "timestamp", Type: bigquery.TimestampFieldType},
+		{Name: "order", Type: bigquery.IntegerFieldType},
+	}
+	if problems := SchemaProblems(want, schema); len(problems) > 0 {
+		t.Errorf("reserved names: %s", strings.Join(problems, "; "))
+	}
+
+	if _, err := bigquery.InferSchema(flexibleNameRow{}); err == nil {
+		t.Error(`flexible name: tag "temp-c" was accepted, want an error`)
+	}
+}
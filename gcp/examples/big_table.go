@@ -1,14 +1,46 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/bigtable"
 	"github.com/joho/godotenv"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"tidy/ctxutil"
+	"tidy/device"
+	"tidy/events"
+	"tidy/gcpauth"
+	"tidy/readingpb"
+	"tidy/retry"
+	"tidy/rowkey"
+	"tidy/ttl"
 )
 
 type Config struct {
@@ -16,110 +48,3311 @@ type Config struct {
 	InstanceID   string
 	TableID      string
 	ColumnFamily string
+	Auth         gcpauth.Config
+
+	// MaxRows caps how many rows scanRows reads, so a mistyped prefix can't
+	// walk the whole table. Zero or less means no cap; ScanOptions.MaxRows
+	// overrides it per call.
+	MaxRows int
+
+	// WriteTimeout bounds each write request and ReadTimeout each read,
+	// through ctxutil. Zero means no deadline; long scans usually want none.
+	WriteTimeout time.Duration
+	ReadTimeout  time.Duration
+
+	// Keys is the row-key layout every helper writes, scans and decodes
+	// with; nil means rowkey.Reversed.
+	Keys rowkey.Strategy
+}
+
+// Key layout in effect: Config.Keys or the default rowkey.Reversed
+func (c Config) keys() rowkey.Strategy {
+	if c.Keys == nil {
+		return rowkey.Reversed{}
+	}
+	return c.Keys
+}
+
+// Read cap used when BIG_TABLE_MAX_ROWS is unset
+const defaultMaxRows = 10000
+
+// Write deadline used when BIG_TABLE_WRITE_TIMEOUT is unset
+const defaultWriteTimeout = 10 * time.Second
+
+// Resolve a per-call override against the MaxRows cap: a positive override
+// replaces the cap, a negative one disables it, zero keeps it. 0 = unlimited.
+func (c Config) rowLimit(override int) int {
+	switch {
+	case override > 0:
+		return override
+	case override < 0 || c.MaxRows < 0:
+		return 0
+	}
+	return c.MaxRows
+}
+
+// WriteOptions controls how cell timestamps are assigned on write.
+type WriteOptions struct {
+	// ServerTimestamp stamps cells with bigtable.ServerTime, letting Bigtable
+	// assign the time on arrival instead of trusting the writer's clock.
+	// Use it when many writers with unsynchronised clocks update the same
+	// cells and "last arrival wins" is the desired ordering. Such writes are
+	// not idempotent: a retry creates a second cell version, so they are
+	// never retried. The row key still uses the client's time.
+	ServerTimestamp bool
+
+	// Packed stores all metrics as one JSON cell in the "metrics" column
+	// instead of one cell per metric. A row then costs a single cell's
+	// overhead (key, family, qualifier, timestamp) however many metrics it
+	// has, which adds up at high write volumes. The tradeoff: metrics can no
+	// longer be filtered or fetched individually server-side (e.g. with
+	// columnValueRangeFilter), and updating one metric rewrites them all.
+	// decodeReading understands both layouts.
+	Packed bool
+
+	// Proto stores all metrics as one protobuf-encoded readingpb.Reading
+	// in the "reading_pb" column, taking precedence over Packed. Like
+	// Packed it costs one cell per row, and the binary encoding is smaller
+	// than JSON (a double is 9 bytes however many digits it has) and
+	// checked against a schema on decode. Cells are opaque to value
+	// filters and to tools such as cbt. decodeReading understands it too.
+	Proto bool
+
+	// MaxSkew, when > 0, makes writeRows compare each reading's timestamp
+	// with the local clock. Readings more than MaxSkew in the past or future
+	// usually come from a device with a wrong clock; they are left out and
+	// reported in a *SkewError. With ClampSkew they are written instead,
+	// with the timestamp (and so the row key) moved to the nearest edge of
+	// the window, and still reported. Leave MaxSkew zero for backfills,
+	// whose readings are old on purpose.
+	MaxSkew   time.Duration
+	ClampSkew bool
+}
+
+// SkewError lists readings whose timestamps fell outside the MaxSkew window.
+type SkewError struct {
+	Readings []Reading // as received, before any clamping
+	Clamped  bool      // whether they were written with clamped timestamps
+}
+
+func (e *SkewError) Error() string {
+	action := "skipped"
+	if e.Clamped {
+		action = "clamped"
+	}
+	return fmt.Sprintf("%d readings with skewed timestamps %s (first: %s at %s)",
+		len(e.Readings), action, e.Readings[0].DeviceID, e.Readings[0].Timestamp.UTC().Format(time.RFC3339))
+}
+
+// checkSkew splits readings into those to write and those outside
+// [now-maxSkew, now+maxSkew]. When clamp is set the skewed ones are also
+// in the first slice, with their timestamps moved into the window.
+func checkSkew(readings []Reading, now time.Time, maxSkew time.Duration, clamp bool) (write, skewed []Reading) {
+	lo, hi := now.Add(-maxSkew), now.Add(maxSkew)
+	write = make([]Reading, 0, len(readings))
+	for _, rd := range readings {
+		switch {
+		case rd.Timestamp.Before(lo):
+			skewed = append(skewed, rd)
+			rd.Timestamp = lo
+		case rd.Timestamp.After(hi):
+			skewed = append(skewed, rd)
+			rd.Timestamp = hi
+		default:
+			write = append(write, rd)
+			continue
+		}
+		if clamp {
+			write = append(write, rd)
+		}
+	}
+	return write, skewed
+}
+
+// Cell timestamp for a value observed at t
+func (o WriteOptions) cellTimestamp(t time.Time) bigtable.Timestamp {
+	if o.ServerTimestamp {
+		return bigtable.ServerTime
+	}
+	return bigtable.Time(t).TruncateToMilliseconds()
+}
+
+// NullFloat64 is a metric that may be missing from a row, mirroring
+// bigquery.NullFloat64: Valid is false when the cell was absent.
+type NullFloat64 struct {
+	Float64 float64
+	Valid   bool
 }
 
+func (n NullFloat64) String() string {
+	if !n.Valid {
+		return "NULL"
+	}
+	return strconv.FormatFloat(n.Float64, 'f', -1, 64)
+}
+
+// MarshalJSON encodes a missing value as null rather than 0.
+func (n NullFloat64) MarshalJSON() ([]byte, error) {
+	if !n.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(n.Float64)
+}
+
+// Reading is a sensor row decoded from its key and cells.
+// Metrics whose cells are absent are left invalid instead of zero.
+type Reading struct {
+	Key         string      `json:"key"`
+	DeviceID    device.ID   `json:"device_id"`
+	Timestamp   time.Time   `json:"timestamp"`
+	TempC       NullFloat64 `json:"temp_c"`
+	HumidityPct NullFloat64 `json:"hum_pct"`
+
+	// Attrs is device metadata stored with the reading, such as firmware
+	// version or site, one column per attribute in attrFamily.
+	Attrs map[string]string `json:"attrs,omitempty"`
+
+	// Truncated is set when ScanOptions.MaxCellsPerRow cut the row short,
+	// so metrics left invalid may exist but weren't read.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Record an attribute cell, keeping the first (newest) value seen
+func (rd *Reading) setAttr(name string, v []byte) {
+	if _, ok := rd.Attrs[name]; ok {
+		return
+	}
+	if rd.Attrs == nil {
+		rd.Attrs = map[string]string{}
+	}
+	rd.Attrs[name] = string(v)
+}
+
+// attrFamily holds Reading.Attrs. Keeping them out of the metrics family
+// means metric filters and scans restricted to cfg.ColumnFamily never
+// fetch them; create it with ensureFamily before writing attributes.
+const attrFamily = "attrs"
+
 // ----------------------
 // Utility
 // ----------------------
 
-// Load environment variables from .env
-func loadConfig() Config {
+// Load and validate settings from .env / the environment
+func loadConfig() (Config, error) {
 	if err := godotenv.Load(); err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		log.Println("Warning: Could not load .env file.")
 	}
 
-	return Config{
+	cfg := Config{
 		ProjectID:    os.Getenv("PROJECT_ID"),
-		InstanceID:   os.Getenv("INSTANCE_ID"),
-		TableID:      os.Getenv("TABLE_ID"),
-		ColumnFamily: os.Getenv("COLUMN_FAMILY"),
+		InstanceID:   getenv("BIG_TABLE_INSTANCE_ID", "INSTANCE_ID"),
+		TableID:      getenv("BIG_TABLE_TABLE_ID", "TABLE_ID"),
+		ColumnFamily: getenv("BIG_TABLE_COLUMN_FAMILY", "COLUMN_FAMILY"),
+		Auth:         gcpauth.FromEnv(),
+		MaxRows:      defaultMaxRows,
+		WriteTimeout: defaultWriteTimeout,
+	}
+	if v := os.Getenv("BIG_TABLE_MAX_ROWS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, fmt.Errorf("BIG_TABLE_MAX_ROWS must be an integer, got %q", v)
+		}
+		cfg.MaxRows = n
+	}
+	for _, d := range []struct {
+		name string
+		dst  *time.Duration
+	}{{"BIG_TABLE_WRITE_TIMEOUT", &cfg.WriteTimeout}, {"BIG_TABLE_READ_TIMEOUT", &cfg.ReadTimeout}} {
+		if v := os.Getenv(d.name); v != "" {
+			t, err := time.ParseDuration(v)
+			if err != nil || t < 0 {
+				return cfg, fmt.Errorf("%s must be a duration such as 30s, got %q", d.name, v)
+			}
+			*d.dst = t
+		}
+	}
+	if v := os.Getenv("BIG_TABLE_KEY_FORMAT"); v != "" {
+		keys, err := rowkey.Parse(v)
+		if err != nil {
+			return cfg, fmt.Errorf("BIG_TABLE_KEY_FORMAT: %w", err)
+		}
+		cfg.Keys = keys
+	}
+	return cfg, cfg.validate()
+}
+
+// Read name, falling back to its older unprefixed spelling
+func getenv(name, legacy string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return os.Getenv(legacy)
+}
+
+// Column family names allowed by Bigtable
+var familyPattern = regexp.MustCompile(`^[-_.a-zA-Z0-9]+$`)
+
+// Check every setting, reporting all problems in one error
+func (c Config) validate() error {
+	var problems []error
+	for _, kv := range [][2]string{
+		{"PROJECT_ID", c.ProjectID},
+		{"BIG_TABLE_INSTANCE_ID", c.InstanceID},
+		{"BIG_TABLE_TABLE_ID", c.TableID},
+		{"BIG_TABLE_COLUMN_FAMILY", c.ColumnFamily},
+	} {
+		if kv[1] == "" {
+			problems = append(problems, fmt.Errorf("%s is not set", kv[0]))
+		}
+	}
+	if c.ProjectID == "your-gcp-project-id" {
+		problems = append(problems, fmt.Errorf("PROJECT_ID is still the placeholder; update your .env file"))
+	}
+	if c.ColumnFamily != "" && !familyPattern.MatchString(c.ColumnFamily) {
+		problems = append(problems, fmt.Errorf("BIG_TABLE_COLUMN_FAMILY %q is not a valid column family name", c.ColumnFamily))
+	}
+	if v := os.Getenv("BIG_TABLE_EXPORT_JSONL"); v != "" && v != "0" && v != "1" {
+		problems = append(problems, fmt.Errorf("BIG_TABLE_EXPORT_JSONL must be 0 or 1, got %q", v))
 	}
+	if err := c.Auth.Validate(); err != nil {
+		problems = append(problems, err)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(problems...))
+	}
+	return nil
+}
+
+// Decode a single cell value into the matching Reading field.
+// Columns the Reading doesn't model are ignored.
+func decodeCell(rd *Reading, col string, v []byte) error {
+	var dst *NullFloat64
+	switch col {
+	case "temp_c":
+		dst = &rd.TempC
+	case "hum_pct":
+		dst = &rd.HumidityPct
+	case packedColumn:
+		return unpackMetrics(rd, v)
+	case protoColumn:
+		return unmarshalMetrics(rd, v)
+	default:
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(string(v), 64)
+	if err != nil {
+		return err
+	}
+	*dst = NullFloat64{Float64: f, Valid: true}
+	return nil
+}
+
+// packedColumn holds every metric of a row when WriteOptions.Packed is set.
+const packedColumn = "metrics"
+
+// Encode metric column -> value pairs as one packed JSON cell.
+// Values keep the same text form as unpacked cells, e.g. {"temp_c":"27.4"}.
+func packMetrics(metrics map[string]string) []byte {
+	b, _ := json.Marshal(metrics) // a map[string]string always marshals
+	return b
+}
+
+// Decode a packed cell, applying each metric as if it were its own column
+func unpackMetrics(rd *Reading, v []byte) error {
+	var metrics map[string]string
+	if err := json.Unmarshal(v, &metrics); err != nil {
+		return err
+	}
+	for col, mv := range metrics {
+		if col == packedColumn {
+			continue
+		}
+		if err := decodeCell(rd, col, []byte(mv)); err != nil {
+			return fmt.Errorf("%s: %w", col, err)
+		}
+	}
+	return nil
+}
+
+// protoColumn holds every metric of a row when WriteOptions.Proto is set.
+const protoColumn = "reading_pb"
+
+// Encode a Reading's metrics as a readingpb.Reading; invalid ones are left
+// unset rather than written as 0
+func marshalMetrics(rd Reading) []byte {
+	var pb readingpb.Reading
+	if rd.TempC.Valid {
+		pb.TempC = proto.Float64(rd.TempC.Float64)
+	}
+	if rd.HumidityPct.Valid {
+		pb.HumPct = proto.Float64(rd.HumidityPct.Float64)
+	}
+	b, _ := proto.Marshal(&pb) // scalar fields always marshal
+	return b
+}
+
+// Decode a protobuf cell, leaving metrics it doesn't set untouched
+func unmarshalMetrics(rd *Reading, v []byte) error {
+	var pb readingpb.Reading
+	if err := proto.Unmarshal(v, &pb); err != nil {
+		return err
+	}
+	if pb.TempC != nil {
+		rd.TempC = NullFloat64{Float64: pb.GetTempC(), Valid: true}
+	}
+	if pb.HumPct != nil {
+		rd.HumidityPct = NullFloat64{Float64: pb.GetHumPct(), Valid: true}
+	}
+	return nil
+}
+
+// Decode a row into a Reading, using the newest cell of each column.
+// keys is the layout the row was written with.
+func decodeReading(r bigtable.Row, keys rowkey.Strategy) (Reading, error) {
+	deviceID, ts, err := keys.Decode(r.Key())
+	if err != nil {
+		return Reading{}, err
+	}
+	rd := Reading{Key: r.Key(), DeviceID: deviceID, Timestamp: ts}
+
+	seen := map[string]bool{}
+	for fam, items := range r {
+		for _, it := range items {
+			_, col, _ := strings.Cut(it.Column, ":")
+			if seen[it.Column] {
+				continue // older version; cells arrive newest first
+			}
+			seen[it.Column] = true
+
+			if fam == attrFamily {
+				rd.setAttr(col, it.Value)
+				continue
+			}
+			if err := decodeCell(&rd, col, it.Value); err != nil {
+				return Reading{}, fmt.Errorf("row %s: %s: %w", r.Key(), col, err)
+			}
+		}
+	}
+	return rd, nil
+}
+
+// ----------------------
+// Throttling
+// ----------------------
+
+// ThrottledError reports that Bigtable rejected a request with RESOURCE_EXHAUSTED.
+// RetryDelay is the backoff suggested by the server's RetryInfo, or zero if none was sent.
+type ThrottledError struct {
+	RetryDelay time.Duration
+	Err        error
+}
+
+func (e *ThrottledError) Error() string {
+	if e.RetryDelay > 0 {
+		return fmt.Sprintf("bigtable throttled (retry after %v): %v", e.RetryDelay, e.Err)
+	}
+	return fmt.Sprintf("bigtable throttled: %v", e.Err)
+}
+
+func (e *ThrottledError) Unwrap() error { return e.Err }
+
+// asThrottled converts a RESOURCE_EXHAUSTED error into a *ThrottledError,
+// extracting RetryInfo from the gRPC status details. Other errors pass through.
+func asThrottled(err error) error {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.ResourceExhausted {
+		return err
+	}
+
+	te := &ThrottledError{Err: err}
+	for _, d := range st.Details() {
+		if ri, ok := d.(*errdetails.RetryInfo); ok {
+			te.RetryDelay = ri.GetRetryDelay().AsDuration()
+			break
+		}
+	}
+	return te
+}
+
+// Apply a mutation under the bigtable.write deadline, surfacing throttling
+// as *ThrottledError
+func applyThrottled(ctx context.Context, tbl *bigtable.Table, key string, mut *bigtable.Mutation, opts ...bigtable.ApplyOption) error {
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.write")
+	defer cancel()
+	return ctxutil.Wrap(ctx, asThrottled(tbl.Apply(ctx, key, mut, opts...)))
+}
+
+// Read rows under the bigtable.read deadline, surfacing throttling as
+// *ThrottledError
+func readRowsThrottled(ctx context.Context, tbl *bigtable.Table, rs bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error {
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.read")
+	defer cancel()
+	return ctxutil.Wrap(ctx, asThrottled(tbl.ReadRows(ctx, rs, f, opts...)))
 }
 
-// Generate a row key using reversed timestamp to avoid hotspotting
-func rowKey(deviceID string, t time.Time) string {
-	reversed := ^uint64(uint64(t.UnixMilli()))
-	return fmt.Sprintf("%s#%d", deviceID, reversed)
+// retryThrottled calls fn up to attempts times, retrying only on *ThrottledError.
+// It waits for the server-suggested delay when present, otherwise backs off exponentially.
+func retryThrottled(ctx context.Context, attempts int, fn func() error) error {
+	backoff := 500 * time.Millisecond
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+
+		var te *ThrottledError
+		if !errors.As(err, &te) || i == attempts-1 {
+			return err
+		}
+
+		delay := te.RetryDelay
+		if delay == 0 {
+			delay = backoff
+			backoff *= 2
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return err
 }
 
 // ----------------------
 // Bigtable operations
 // ----------------------
 
+// Client options for Bigtable. The client connects to the emulator by itself
+// when BIGTABLE_EMULATOR_HOST is set, and needs no credentials there.
+func bigtableClientOptions(ctx context.Context, cfg Config) ([]option.ClientOption, error) {
+	if os.Getenv("BIGTABLE_EMULATOR_HOST") != "" {
+		return nil, nil
+	}
+	return gcpauth.ClientOptions(ctx, cfg.Auth)
+}
+
 // Create and return a Bigtable client
 func createBigtableClient(ctx context.Context, cfg Config) *bigtable.Client {
-	client, err := bigtable.NewClient(ctx, cfg.ProjectID, cfg.InstanceID)
+	opts, err := bigtableClientOptions(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Failed to resolve credentials: %v", err)
+	}
+
+	client, err := bigtable.NewClient(ctx, cfg.ProjectID, cfg.InstanceID, opts...)
 	if err != nil {
 		log.Fatalf("Failed to create Bigtable client: %v", err)
 	}
 	return client
 }
 
-// Write a new row
-func writeRow(ctx context.Context, tbl *bigtable.Table, cfg Config, deviceID string) string {
-	key := rowKey(deviceID, time.Now())
+// Write a new row, with attrs (may be nil) stored in attrFamily
+func writeRow(ctx context.Context, tbl *bigtable.Table, cfg Config, deviceID device.ID, attrs map[string]string, opts WriteOptions) string {
+	now := time.Now()
+	key := cfg.keys().Encode(deviceID, now)
+	ts := opts.cellTimestamp(now)
 	mut := bigtable.NewMutation()
-	mut.Set(cfg.ColumnFamily, "temp_c", bigtable.Now(), []byte("27.4"))
-	mut.Set(cfg.ColumnFamily, "hum_pct", bigtable.Now(), []byte("61"))
+	switch {
+	case opts.Proto:
+		mut.Set(cfg.ColumnFamily, protoColumn, ts, marshalMetrics(Reading{
+			TempC:       NullFloat64{Float64: 27.4, Valid: true},
+			HumidityPct: NullFloat64{Float64: 61, Valid: true},
+		}))
+	case opts.Packed:
+		mut.Set(cfg.ColumnFamily, packedColumn, ts, packMetrics(map[string]string{"temp_c": "27.4", "hum_pct": "61"}))
+	default:
+		mut.Set(cfg.ColumnFamily, "temp_c", ts, []byte("27.4"))
+		mut.Set(cfg.ColumnFamily, "hum_pct", ts, []byte("61"))
+	}
+	setAttrs(mut, attrs, ts)
 
-	if err := tbl.Apply(ctx, key, mut); err != nil {
+	attempts := 3
+	if opts.ServerTimestamp {
+		attempts = 1 // not idempotent
+	}
+	err := retryThrottled(ctx, attempts, func() error {
+		return applyThrottled(ctx, tbl, key, mut)
+	})
+	if err != nil {
 		log.Fatalf("Failed to write row: %v", err)
 	}
 	fmt.Println("Wrote row:", key)
 	return key
 }
 
-// Read a single row by key
-func readRow(ctx context.Context, tbl *bigtable.Table, key string) {
+// Build the mutation storing a Reading's metrics
+func readingMutation(cfg Config, rd Reading, opts WriteOptions) *bigtable.Mutation {
+	ts := opts.cellTimestamp(rd.Timestamp)
+	mut := bigtable.NewMutation()
+	// Missing metrics are simply not written, so they read back as invalid.
+	metrics := map[string]string{}
+	if rd.TempC.Valid {
+		metrics["temp_c"] = rd.TempC.String()
+	}
+	if rd.HumidityPct.Valid {
+		metrics["hum_pct"] = rd.HumidityPct.String()
+	}
+	setAttrs(mut, rd.Attrs, ts)
+
+	if opts.Proto {
+		mut.Set(cfg.ColumnFamily, protoColumn, ts, marshalMetrics(rd))
+		return mut
+	}
+	if opts.Packed {
+		mut.Set(cfg.ColumnFamily, packedColumn, ts, packMetrics(metrics))
+		return mut
+	}
+	for col, v := range metrics {
+		mut.Set(cfg.ColumnFamily, col, ts, []byte(v))
+	}
+	return mut
+}
+
+// Add one attrFamily cell per attribute. Attributes are never packed: each
+// stays readable and filterable on its own.
+func setAttrs(mut *bigtable.Mutation, attrs map[string]string, ts bigtable.Timestamp) {
+	for name, v := range attrs {
+		mut.Set(attrFamily, name, ts, []byte(v))
+	}
+}
+
+// Parse attributes given as name=value pairs separated by commas
+func parseAttrs(s string) (map[string]string, error) {
+	attrs := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		name, v, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("attribute %q is not name=value", pair)
+		}
+		attrs[name] = strings.TrimSpace(v)
+	}
+	return attrs, nil
+}
+
+// writeRowIfAbsent writes rd under key only if the row doesn't exist yet,
+// using a CheckAndMutate whose predicate matches any existing cell.
+// Generate key once (see rowkey.Unique) and reuse it for every retry: a
+// retry after a lost response then becomes a no-op instead of a duplicate,
+// giving at-most-once writes. Returns false if the row already existed,
+// which after an internal retry can mean an earlier attempt wrote it.
+func writeRowIfAbsent(ctx context.Context, tbl *bigtable.Table, cfg Config, key string, rd Reading, opts WriteOptions) (bool, error) {
+	filter := bigtable.ChainFilters(bigtable.CellsPerRowLimitFilter(1), bigtable.StripValueFilter())
+	cond := bigtable.NewCondMutation(filter, nil, readingMutation(cfg, rd, opts))
+
+	var exists bool
+	err := retryThrottled(ctx, 3, func() error {
+		return applyThrottled(ctx, tbl, key, cond, bigtable.GetCondMutationResult(&exists))
+	})
+	if err != nil {
+		return false, fmt.Errorf("conditional write %s: %w", key, err)
+	}
+	return !exists, nil
+}
+
+// alertFamily holds alert markers. Give it a max-age GC policy of alertTTL
+// (see ttl.SetFamily) so markers disappear on their own once the alert is
+// stale; reads that must not see expired markers use ttl.LiveCellsFilter.
+const (
+	alertFamily = "alerts"
+	alertTTL    = time.Hour
+)
+
+// Build a predicate matching a row whose latest temp_c cell is above
+// threshold. Values are decimal text, and for non-negative numbers without
+// an exponent (how NullFloat64.String writes them) byte order equals numeric
+// order only when the integer parts have the same number of digits. So a
+// cell passes if its integer part is longer than the threshold's, or the
+// same length and bytewise greater.
+func tempAboveFilter(family string, threshold float64) (bigtable.Filter, error) {
+	if threshold < 0 || math.IsNaN(threshold) || math.IsInf(threshold, 0) {
+		return nil, fmt.Errorf("threshold must be a non-negative number, got %v", threshold)
+	}
+	text := strconv.FormatFloat(threshold, 'f', -1, 64)
+	intPart, _, _ := strings.Cut(text, ".")
+	n := len(intPart)
+
+	longer := bigtable.ValueFilter(fmt.Sprintf(`^[1-9][0-9]{%d,}(\.[0-9]+)?$`, n))
+	sameLength := bigtable.ChainFilters(
+		bigtable.ValueFilter(fmt.Sprintf(`^[0-9]{%d}(\.[0-9]+)?$`, n)),
+		bigtable.ValueRangeFilter([]byte(text+"\x00"), nil), // strictly after text
+	)
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter(regexp.QuoteMeta(family)),
+		bigtable.ColumnFilter("temp_c"),
+		bigtable.LatestNFilter(1),
+		bigtable.InterleaveFilters(longer, sameLength),
+	), nil
+}
+
+// flagHighTemp sets an alert marker on the row under key if its latest
+// temperature is above threshold, in one CheckAndMutate so the check and the
+// write can't race another writer. The marker goes into alertFamily, stamped
+// with the current time so the family's max-age policy expires it. Returns
+// whether the alert branch fired. Packed and proto rows keep temp_c inside
+// a single cell that value filters can't see, so they never fire.
+func flagHighTemp(ctx context.Context, tbl *bigtable.Table, cfg Config, key string, threshold float64) (bool, error) {
+	pred, err := tempAboveFilter(cfg.ColumnFamily, threshold)
+	if err != nil {
+		return false, err
+	}
+	mark := bigtable.NewMutation()
+	mark.Set(alertFamily, "high_temp", bigtable.Now(), []byte(strconv.FormatFloat(threshold, 'f', -1, 64)))
+	cond := bigtable.NewCondMutation(pred, mark, nil)
+
+	var fired bool
+	err = retryThrottled(ctx, 3, func() error {
+		return applyThrottled(ctx, tbl, key, cond, bigtable.GetCondMutationResult(&fired))
+	})
+	if err != nil {
+		return false, fmt.Errorf("conditional alert %s: %w", key, err)
+	}
+	return fired, nil
+}
+
+// writeRows writes readings in a single ApplyBulk call. Each row key comes
+// from the reading's DeviceID and Timestamp; per-row failures, or the
+// failure of the whole call, and a *SkewError when opts.MaxSkew catches
+// any, are joined into the returned error.
+func writeRows(ctx context.Context, tbl *bigtable.Table, cfg Config, readings []Reading, opts WriteOptions) error {
+	var errs []error
+	if opts.MaxSkew > 0 {
+		var skewed []Reading
+		readings, skewed = checkSkew(readings, time.Now(), opts.MaxSkew, opts.ClampSkew)
+		if len(skewed) > 0 {
+			errs = append(errs, &SkewError{Readings: skewed, Clamped: opts.ClampSkew})
+		}
+		if len(readings) == 0 {
+			return errors.Join(errs...)
+		}
+	}
+
+	keys := make([]string, len(readings))
+	muts := make([]*bigtable.Mutation, len(readings))
+	for i, rd := range readings {
+		keys[i] = cfg.keys().Encode(rd.DeviceID, rd.Timestamp)
+		muts[i] = readingMutation(cfg, rd, opts)
+	}
+
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.write.bulk")
+	defer cancel()
+	rowErrs, err := tbl.ApplyBulk(ctx, keys, muts)
+	if err != nil {
+		err = fmt.Errorf("tbl.ApplyBulk: %w", ctxutil.Wrap(ctx, asThrottled(err)))
+		if len(errs) == 0 {
+			return err // unjoined, so callers don't count it as one failed row
+		}
+		return errors.Join(append(errs, err)...)
+	}
+
+	for i, rowErr := range rowErrs {
+		if rowErr != nil {
+			errs = append(errs, fmt.Errorf("row %s: %w", keys[i], rowErr))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// backfillBatch is how many CSV rows backfillFromCSV sends per ApplyBulk.
+const backfillBatch = 1000
+
+// backfillFromCSV loads historical readings from a CSV file with rows of
+// deviceID,timestamp,temp_c,hum_pct (timestamp in RFC 3339, empty metrics
+// left absent; an optional header row is skipped) and writes them with
+// writeRows in batches. Cells are stamped with each reading's own time, never
+// the server's, and row keys are encoded from it with cfg's key layout, so
+// backfilled rows sort exactly like live ones. Malformed lines and failed rows don't stop the
+// load; they are joined into the returned error alongside the count of rows
+// written.
+func backfillFromCSV(ctx context.Context, tbl *bigtable.Table, cfg Config, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 4
+	r.ReuseRecord = true
+
+	var (
+		errs    []error
+		batch   []Reading
+		written int
+	)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := writeRows(ctx, tbl, cfg, batch, WriteOptions{})
+		if err == nil {
+			written += len(batch)
+		} else if rowErrs, ok := err.(interface{ Unwrap() []error }); ok {
+			written += len(batch) - len(rowErrs.Unwrap()) // only some rows failed
+			errs = append(errs, err)
+		} else {
+			errs = append(errs, err)
+		}
+		batch = batch[:0]
+	}
+
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, err) // csv errors already name the line
+			continue
+		}
+		if line == 1 && !strings.ContainsAny(rec[1], "0123456789") {
+			continue // header
+		}
+
+		rd, err := parseBackfillRecord(rec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		batch = append(batch, rd)
+		if len(batch) == backfillBatch {
+			flush()
+		}
+	}
+	flush()
+
+	return written, errors.Join(errs...)
+}
+
+// Parse one deviceID,timestamp,temp_c,hum_pct record into a Reading
+func parseBackfillRecord(rec []string) (Reading, error) {
+	id, err := device.NewID(rec[0])
+	if err != nil {
+		return Reading{}, err
+	}
+	ts, err := time.Parse(time.RFC3339, rec[1])
+	if err != nil {
+		return Reading{}, fmt.Errorf("timestamp: %w", err)
+	}
+	rd := Reading{DeviceID: id, Timestamp: ts}
+
+	for _, m := range []struct {
+		name string
+		raw  string
+		dst  *NullFloat64
+	}{{"temp_c", rec[2], &rd.TempC}, {"hum_pct", rec[3], &rd.HumidityPct}} {
+		if m.raw == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(m.raw, 64)
+		if err != nil {
+			return Reading{}, fmt.Errorf("%s: %w", m.name, err)
+		}
+		*m.dst = NullFloat64{Float64: v, Valid: true}
+	}
+	return rd, nil
+}
+
+// Read a single row by key and print its cells to w
+func readRow(ctx context.Context, tbl *bigtable.Table, key string, w io.Writer) error {
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.read.row")
+	defer cancel()
 	r, err := tbl.ReadRow(ctx, key)
 	if err != nil {
-		log.Fatalf("Failed to read row: %v", err)
+		return fmt.Errorf("tbl.ReadRow: %w", ctxutil.Wrap(ctx, err))
 	}
 
-	fmt.Println("Reading row:", key)
+	fmt.Fprintln(w, "Reading row:", key)
 	for fam, items := range r {
-		fmt.Println("Family:", fam)
+		fmt.Fprintln(w, "Family:", fam)
 		for _, it := range items {
-			fmt.Printf("  %s @%v = %s\n", it.Column, it.Timestamp, string(it.Value))
+			fmt.Fprintf(w, "  %s @%v = %s\n", it.Column, it.Timestamp, string(it.Value))
 		}
 	}
+	return nil
 }
 
-// Scan all rows with a specific prefix
-func scanRows(ctx context.Context, tbl *bigtable.Table, prefix string) {
-	fmt.Println("Scanning rows with prefix:", prefix)
-	rt := bigtable.PrefixRange(prefix)
+// Print up to n versions of each column of a row, grouped by column and
+// newest first, with each cell's timestamp. Bigtable keeps older versions
+// until garbage collection removes them, so a column written several times
+// has several cells; readRow shows them interleaved, this makes the history
+// explicit.
+func printRowVersions(ctx context.Context, tbl *bigtable.Table, key string, n int, w io.Writer) error {
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.read.row")
+	defer cancel()
+	r, err := tbl.ReadRow(ctx, key, bigtable.RowFilter(bigtable.LatestNFilter(n)))
+	if err != nil {
+		return fmt.Errorf("tbl.ReadRow: %w", ctxutil.Wrap(ctx, err))
+	}
+	if r == nil {
+		return fmt.Errorf("row %s not found", key)
+	}
 
-	err := tbl.ReadRows(ctx, rt,
-		func(r bigtable.Row) bool {
-			fmt.Println("Row:", r.Key())
-			// readRow(ctx, tbl, r.Key())
-			return true // continue scanning
-		},
-		bigtable.RowFilter(bigtable.LatestNFilter(1)), // only latest version
+	fmt.Fprintf(w, "Row %s (up to %d versions per column):\n", key, n)
+	families := make([]string, 0, len(r))
+	for fam := range r {
+		families = append(families, fam)
+	}
+	sort.Strings(families)
+
+	for _, fam := range families {
+		byColumn := map[string][]bigtable.ReadItem{}
+		var columns []string
+		for _, it := range r[fam] {
+			if _, ok := byColumn[it.Column]; !ok {
+				columns = append(columns, it.Column)
+			}
+			byColumn[it.Column] = append(byColumn[it.Column], it)
+		}
+		sort.Strings(columns)
+
+		for _, col := range columns {
+			versions := byColumn[col]
+			// Cells arrive newest first, but don't rely on it for display.
+			sort.SliceStable(versions, func(i, j int) bool { return versions[i].Timestamp > versions[j].Timestamp })
+			fmt.Fprintf(w, "  %s (%d versions)\n", col, len(versions))
+			for i, it := range versions {
+				fmt.Fprintf(w, "    [%d] %s = %s\n", i, it.Timestamp.Time().UTC().Format(time.RFC3339Nano), string(it.Value))
+			}
+		}
+	}
+	return nil
+}
+
+// Read a row as it was at asOf: the newest cell of each column written at or
+// before that time. Bigtable keeps older versions until garbage collection
+// removes them, so this reconstructs past state as far back as the family's
+// GC policy allows. The range filter's end is exclusive and Bigtable stores
+// milliseconds, so the bound is moved one millisecond past asOf.
+func readAsOf(ctx context.Context, tbl *bigtable.Table, keys rowkey.Strategy, key string, asOf time.Time) (Reading, error) {
+	end := asOf.Truncate(time.Millisecond).Add(time.Millisecond)
+	filter := bigtable.ChainFilters(
+		bigtable.TimestampRangeFilter(time.Time{}, end),
+		bigtable.LatestNFilter(1),
 	)
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.read.row")
+	defer cancel()
+	r, err := tbl.ReadRow(ctx, key, bigtable.RowFilter(filter))
 	if err != nil {
-		log.Fatalf("Failed to scan rows: %v", err)
+		return Reading{}, fmt.Errorf("tbl.ReadRow: %w", ctxutil.Wrap(ctx, err))
+	}
+	if r == nil {
+		return Reading{}, fmt.Errorf("row %s has no cells at or before %s", key, asOf.UTC().Format(time.RFC3339Nano))
 	}
+	return decodeReading(r, keys)
 }
 
-// ----------------------
-// Main
-// ----------------------
-func main() {
-	// Load configuration
-	cfg := loadConfig()
+// FirstLast is a row as first written and as it reads now.
+type FirstLast struct {
+	First Reading // oldest cell of each column written before the bound
+	Last  Reading // newest cell of each column
+}
 
-	ctx := context.Background()
-	client := createBigtableClient(ctx, cfg)
-	defer client.Close()
+// Read the oldest and newest version of every column of a row in one
+// request. An interleave filter sends each cell matching either branch:
+// the latest version, and every version written before firstUntil.
+// Bigtable has no "oldest N" filter, so the timestamp bound is what keeps
+// the second branch small; set it just past the original write (the key's
+// timestamp, for rows written with client timestamps) and the oldest cell
+// it leaves per column is picked here. A column with no cell before
+// firstUntil is left invalid in First. As with readAsOf, the bound is
+// exclusive at millisecond precision.
+func readFirstLast(ctx context.Context, tbl *bigtable.Table, keys rowkey.Strategy, key string, firstUntil time.Time) (FirstLast, error) {
+	end := firstUntil.Truncate(time.Millisecond)
+	filter := bigtable.InterleaveFilters(
+		bigtable.LatestNFilter(1),
+		bigtable.TimestampRangeFilter(time.Time{}, end),
+	)
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.read.row")
+	defer cancel()
+	r, err := tbl.ReadRow(ctx, key, bigtable.RowFilter(filter))
+	if err != nil {
+		return FirstLast{}, fmt.Errorf("tbl.ReadRow: %w", ctxutil.Wrap(ctx, err))
+	}
+	if r == nil {
+		return FirstLast{}, fmt.Errorf("row %s not found", key)
+	}
 
-	tbl := client.Open(cfg.TableID)
+	// Cells arrive grouped by column, newest first; a cell matching both
+	// branches is sent twice, which the comparisons below tolerate.
+	first, last := bigtable.Row{}, bigtable.Row{}
+	bound := bigtable.Time(end)
+	for fam, items := range r {
+		seen := map[string]bool{}
+		oldest := map[string]bigtable.ReadItem{}
+		for _, it := range items {
+			if !seen[it.Column] {
+				seen[it.Column] = true
+				last[fam] = append(last[fam], it)
+			}
+			if it.Timestamp < bound {
+				oldest[it.Column] = it
+			}
+		}
+		for _, it := range oldest {
+			first[fam] = append(first[fam], it)
+		}
+	}
 
-	// Run operations
-	rowKey := writeRow(ctx, tbl, cfg, "sensor-42")
+	var fl FirstLast
+	if fl.Last, err = decodeReading(last, keys); err != nil {
+		return FirstLast{}, err
+	}
+	if len(first) == 0 {
+		fl.First = Reading{Key: fl.Last.Key, DeviceID: fl.Last.DeviceID, Timestamp: fl.Last.Timestamp}
+		return fl, nil
+	}
+	if fl.First, err = decodeReading(first, keys); err != nil {
+		return FirstLast{}, err
+	}
+	return fl, nil
+}
+
+// Build a filter matching one column whose value lies in [start, end).
+// Values are compared as raw bytes, so for our string-encoded metrics the
+// range is lexicographic ("27.4" < "3") and works best with fixed-width values.
+func columnValueRangeFilter(family, column string, start, end []byte) bigtable.Filter {
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter(regexp.QuoteMeta(family)),
+		bigtable.ColumnFilter(regexp.QuoteMeta(column)),
+		bigtable.ValueRangeFilter(start, end),
+	)
+}
+
+// Read the cells of one row that pass filter. Returns an empty slice if
+// the row doesn't exist or nothing matched.
+func readFiltered(ctx context.Context, tbl *bigtable.Table, key string, filter bigtable.Filter) ([]bigtable.ReadItem, error) {
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.read.row")
+	defer cancel()
+	r, err := tbl.ReadRow(ctx, key, bigtable.RowFilter(filter))
+	if err != nil {
+		return nil, fmt.Errorf("tbl.ReadRow: %w", ctxutil.Wrap(ctx, err))
+	}
+
+	var cells []bigtable.ReadItem
+	for _, items := range r {
+		cells = append(cells, items...)
+	}
+	return cells, nil
+}
+
+// ScanOptions adds optional diagnostics to scanRows.
+type ScanOptions struct {
+	// RowSizeThreshold, when > 0, reports rows whose key plus cell columns
+	// and values exceed this many bytes to OnLargeRow. Wide rows slow down
+	// reads and are a common time-series key design problem.
+	RowSizeThreshold int
+	OnLargeRow       func(key string, size int)
+
+	// MaxRows overrides Config.MaxRows for this scan (see Config.rowLimit).
+	MaxRows int
+
+	// MaxCellsPerRow, when > 0, reads at most this many cells of each row,
+	// so a pathologically wide row can't blow up memory. Rows that had
+	// more are decoded from the cells read and marked Truncated.
+	MaxCellsPerRow int
+}
+
+// Approximate stored size of a row as returned by the read
+func rowSize(r bigtable.Row) int {
+	size := len(r.Key())
+	for _, items := range r {
+		for _, it := range items {
+			size += len(it.Column) + len(it.Value)
+		}
+	}
+	return size
+}
+
+// Scan rows with a specific prefix, up to the configured row limit, and
+// push each decoded Reading into sink. The caller owns sink and closes it
+// afterwards. Returns true if the limit cut the scan short. Rows are
+// decoded with cfg's key layout; a device's prefix is cfg.keys().Prefix.
+func scanRows(ctx context.Context, tbl *bigtable.Table, cfg Config, prefix string, opts ScanOptions, sink ReadingSink) (bool, error) {
+	rt := bigtable.PrefixRange(prefix)
+
+	filter := bigtable.LatestNFilter(1) // only latest version
+	if opts.MaxCellsPerRow > 0 {
+		// One extra cell tells a row of exactly the limit from a wider one.
+		filter = bigtable.ChainFilters(filter, bigtable.CellsPerRowLimitFilter(opts.MaxCellsPerRow+1))
+	}
+	readOpts := []bigtable.ReadOption{bigtable.RowFilter(filter)}
+	limit := cfg.rowLimit(opts.MaxRows)
+	if limit > 0 {
+		// One extra row tells a result of exactly limit rows from a truncated one.
+		readOpts = append(readOpts, bigtable.LimitRows(int64(limit)+1))
+	}
+
+	rows, truncated := 0, false
+	var sinkErr error
+	err := readRowsThrottled(ctx, tbl, rt,
+		func(r bigtable.Row) bool {
+			if limit > 0 && rows == limit {
+				truncated = true
+				return false
+			}
+			rows++
+			r, cut := limitCells(r, opts.MaxCellsPerRow)
+			rd, err := decodeReading(r, cfg.keys())
+			if err == nil {
+				rd.Truncated = cut
+				err = sink.Write(rd)
+			}
+			if err != nil {
+				sinkErr = err
+				return false
+			}
+			if opts.RowSizeThreshold > 0 && opts.OnLargeRow != nil {
+				// Only the latest versions are read, so this measures the
+				// live row rather than its full version history.
+				if size := rowSize(r); size > opts.RowSizeThreshold {
+					opts.OnLargeRow(r.Key(), size)
+				}
+			}
+			return true // continue scanning
+		},
+		readOpts...,
+	)
+	if err != nil {
+		return false, fmt.Errorf("tbl.ReadRows: %w", err)
+	}
+	return truncated, sinkErr
+}
+
+// Keep at most n cells of r (all if n <= 0), reporting whether any were
+// dropped. Cells are kept in the order the server returns them: families
+// in name order, then columns, so the same cells survive every time.
+func limitCells(r bigtable.Row, n int) (bigtable.Row, bool) {
+	if n <= 0 {
+		return r, false
+	}
+	total := 0
+	for _, items := range r {
+		total += len(items)
+	}
+	if total <= n {
+		return r, false
+	}
+
+	families := make([]string, 0, len(r))
+	for fam := range r {
+		families = append(families, fam)
+	}
+	sort.Strings(families)
+
+	out := bigtable.Row{}
+	for _, fam := range families {
+		if n == 0 {
+			break
+		}
+		items := r[fam]
+		if len(items) > n {
+			items = items[:n]
+		}
+		out[fam] = items
+		n -= len(items)
+	}
+	return out, true
+}
+
+// ReadAmplification compares what a scan delivered with what the caller
+// kept. Bytes are rowSize estimates of the cells returned.
+type ReadAmplification struct {
+	RowsRead, RowsMatched   int
+	BytesRead, BytesMatched int
+}
+
+// Factor is bytes read per byte kept: 1 means nothing was wasted. It is
+// +Inf when nothing matched.
+func (a ReadAmplification) Factor() float64 {
+	if a.BytesMatched == 0 {
+		return math.Inf(1)
+	}
+	return float64(a.BytesRead) / float64(a.BytesMatched)
+}
+
+// Scan prefix with filter (nil reads every cell version) and apply match to
+// each decoded row client-side, measuring how much of what was read was
+// thrown away. Comparing filters on the same prefix shows what server-side
+// filtering saves: fewer rows and bytes cross the network and get decoded.
+// The server still reads every row in the range, though; only a key design
+// that narrows the range (a tighter prefix) saves that work as well.
+func measureReadAmplification(ctx context.Context, tbl *bigtable.Table, cfg Config, prefix string, filter bigtable.Filter, match func(Reading) bool) (ReadAmplification, error) {
+	var opts []bigtable.ReadOption
+	if filter != nil {
+		opts = append(opts, bigtable.RowFilter(filter))
+	}
+
+	var amp ReadAmplification
+	var decodeErr error
+	err := readRowsThrottled(ctx, tbl, bigtable.PrefixRange(prefix),
+		func(r bigtable.Row) bool {
+			size := rowSize(r)
+			amp.RowsRead++
+			amp.BytesRead += size
+
+			rd, err := decodeReading(r, cfg.keys())
+			if err != nil {
+				decodeErr = err
+				return false
+			}
+			if match(rd) {
+				amp.RowsMatched++
+				amp.BytesMatched += size
+			}
+			return true
+		},
+		opts...,
+	)
+	if err != nil {
+		return amp, fmt.Errorf("tbl.ReadRows: %w", err)
+	}
+	return amp, decodeErr
+}
+
+// ReadingSink receives scanned Readings one at a time, so scans don't care
+// where their output goes. Close flushes anything buffered; it does not
+// close a writer the sink was built on.
+type ReadingSink interface {
+	Write(Reading) error
+	Close() error
+}
+
+// sliceSink collects Readings in memory.
+type sliceSink struct {
+	Readings []Reading
+}
+
+func (s *sliceSink) Write(rd Reading) error {
+	s.Readings = append(s.Readings, rd)
+	return nil
+}
+
+func (s *sliceSink) Close() error { return nil }
+
+// jsonlSink writes one JSON object per Reading, with null for absent metrics.
+type jsonlSink struct {
+	bw  *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONLSink(w io.Writer) *jsonlSink {
+	bw := bufio.NewWriter(w)
+	return &jsonlSink{bw: bw, enc: json.NewEncoder(bw)}
+}
+
+func (s *jsonlSink) Write(rd Reading) error { return s.enc.Encode(rd) }
+
+func (s *jsonlSink) Close() error { return s.bw.Flush() }
+
+// bigQueryBatch is how many Readings bigQuerySink streams per insert.
+const bigQueryBatch = 500
+
+// bigQuerySink streams Readings into a BigQuery events table in batches of
+// bigQueryBatch, mapping the row key to event_id and temp_c to temperature;
+// humidity has no column there and is dropped. The row key is also the
+// InsertID (see events.Saver), so re-exporting the same rows within
+// BigQuery's dedup window doesn't duplicate them.
+type bigQuerySink struct {
+	ctx      context.Context
+	inserter *bigquery.Inserter
+	batch    []*bigquery.StructSaver
+}
+
+func newBigQuerySink(ctx context.Context, client *bigquery.Client, datasetID, tableID string) *bigQuerySink {
+	return &bigQuerySink{ctx: ctx, inserter: client.Dataset(datasetID).Table(tableID).Inserter()}
+}
+
+func (s *bigQuerySink) Write(rd Reading) error {
+	s.batch = append(s.batch, events.Saver(events.Row{
+		EventID:     rd.Key,
+		DeviceID:    rd.DeviceID,
+		Timestamp:   rd.Timestamp,
+		Temperature: bigquery.NullFloat64{Float64: rd.TempC.Float64, Valid: rd.TempC.Valid},
+	}))
+	if len(s.batch) == bigQueryBatch {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *bigQuerySink) flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	if err := s.inserter.Put(s.ctx, s.batch); err != nil {
+		return fmt.Errorf("inserter.Put: %w", err)
+	}
+	s.batch = s.batch[:0]
+	return nil
+}
+
+func (s *bigQuerySink) Close() error { return s.flush() }
+
+// scanRowsFunc decodes each row in rt with keys into a Reading and passes
+// it to fn. Scanning stops at the first decode error or error returned by fn.
+// A nil filter reads every cell version.
+func scanRowsFunc(ctx context.Context, tbl *bigtable.Table, keys rowkey.Strategy, rt bigtable.RowSet, filter bigtable.Filter, fn func(Reading) error) error {
+	var opts []bigtable.ReadOption
+	if filter != nil {
+		opts = append(opts, bigtable.RowFilter(filter))
+	}
+
+	var cbErr error
+	err := readRowsThrottled(ctx, tbl, rt,
+		func(r bigtable.Row) bool {
+			rd, err := decodeReading(r, keys)
+			if err == nil {
+				err = fn(rd)
+			}
+			if err != nil {
+				cbErr = err
+				return false // stop scanning
+			}
+			return true
+		},
+		opts...,
+	)
+	if err != nil {
+		return fmt.Errorf("tbl.ReadRows: %w", err)
+	}
+	return cbErr
+}
+
+// scanRange decodes every row with startKey <= key < endKey, i.e. the
+// half-open range [startKey, endKey) of bigtable.NewRange. An empty endKey
+// means no upper bound. Unlike a prefix scan the range can span devices, e.g.
+// scanRange(ctx, tbl, rowkey.Reversed{}, "sensor-1#", "sensor-3#", nil)
+// covers every sensor-1 and sensor-2* row. A prefix scan is scanRange(p, prefixSuccessor(p)).
+// A nil filter reads every cell version.
+func scanRange(ctx context.Context, tbl *bigtable.Table, keys rowkey.Strategy, startKey, endKey string, filter bigtable.Filter) ([]Reading, error) {
+	var readings []Reading
+	err := scanRowsFunc(ctx, tbl, keys, bigtable.NewRange(startKey, endKey), filter, func(rd Reading) error {
+		readings = append(readings, rd)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readings, nil
+}
+
+// scanRowsPartial collects the latest Reading of each row under prefix.
+// If ctx's deadline passes mid-scan it returns what was read so far with
+// truncated set instead of an error, for best-effort reads under a latency
+// budget. Other errors, including cancellation, are still returned.
+func scanRowsPartial(ctx context.Context, tbl *bigtable.Table, keys rowkey.Strategy, prefix string) (readings []Reading, truncated bool, err error) {
+	err = scanRowsFunc(ctx, tbl, keys, bigtable.PrefixRange(prefix), bigtable.LatestNFilter(1),
+		func(rd Reading) error {
+			readings = append(readings, rd)
+			return nil
+		})
+	if err != nil && isDeadlineExceeded(ctx, err) {
+		return readings, true, nil
+	}
+	return readings, false, err
+}
+
+// isDeadlineExceeded reports whether err came from ctx's deadline. The
+// client may surface it as a gRPC DeadlineExceeded status rather than
+// context.DeadlineExceeded.
+func isDeadlineExceeded(ctx context.Context, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return status.Code(err) == codes.DeadlineExceeded && errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// scanPrefixResumable decodes every row under prefix like scanRowsFunc, but
+// when a scan attempt fails with a retryable error (e.g. its attemptTimeout
+// expired partway through a large scan) it resumes with an exclusive start
+// bound just after the last row handed to fn, rather than starting over, so
+// fn sees each row once. Up to attempts scans are made; fn's own errors and
+// the cancellation of ctx are never retried.
+//
+// The resume point is the full row key, not its parsed timestamp: several
+// rows can share a millisecond (rowkey.Unique suffixes), and keys order by
+// bytes, whatever order that gives the timestamps under keys.
+func scanPrefixResumable(ctx context.Context, tbl *bigtable.Table, keys rowkey.Strategy, prefix string, filter bigtable.Filter, attempts int, attemptTimeout time.Duration, fn func(Reading) error) error {
+	end := prefixSuccessor(prefix)
+	var rs bigtable.RowSet = bigtable.PrefixRange(prefix)
+	var lastKey string
+	var fnErr error
+
+	for i := 0; ; i++ {
+		actx, cancel := context.WithTimeout(ctx, attemptTimeout)
+		err := scanRowsFunc(actx, tbl, keys, rs, filter, func(rd Reading) error {
+			if fnErr = fn(rd); fnErr != nil {
+				return fnErr
+			}
+			lastKey = rd.Key
+			return nil
+		})
+		cancel()
+
+		if err == nil || fnErr != nil || ctx.Err() != nil || i == attempts-1 || !retryableScanError(err) {
+			return err
+		}
+		if lastKey != "" {
+			rs = bigtable.NewOpenRange(lastKey, end)
+		}
+		fmt.Printf("Scan of %q interrupted after %q, resuming: %v\n", prefix, lastKey, err)
+	}
+}
+
+// Report whether a failed scan attempt is worth resuming
+func retryableScanError(err error) bool {
+	var te *ThrottledError
+	return errors.As(err, &te) || retry.Retryable(err)
+}
+
+// Smallest key greater than every key with the given prefix, or "" (no
+// upper bound) if the prefix is all 0xff bytes
+func prefixSuccessor(prefix string) string {
+	b := []byte(prefix)
+	for len(b) > 0 && b[len(b)-1] == 0xff {
+		b = b[:len(b)-1]
+	}
+	if len(b) == 0 {
+		return ""
+	}
+	b[len(b)-1]++
+	return string(b)
+}
+
+// TempSummary aggregates the temperatures of one device over a time window.
+type TempSummary struct {
+	Rows         int // rows scanned
+	Count        int // rows with a valid temperature
+	SkippedCells int // cells that failed to decode and were ignored
+	Min, Max     float64
+	Mean         float64
+}
+
+// summarizeTemps scans deviceID's readings observed in [from, to] and folds
+// them into running min/max/mean as rows arrive, so memory stays constant
+// however long the window. The key range comes from rowkey.Range, so it
+// follows keys' sort order. A cell that doesn't decode is counted in
+// SkippedCells instead of failing the scan.
+func summarizeTemps(ctx context.Context, tbl *bigtable.Table, keys rowkey.Strategy, deviceID device.ID, from, to time.Time) (TempSummary, error) {
+	rr := bigtable.NewRange(rowkey.Range(keys, deviceID, from, to))
+
+	var sum TempSummary
+	err := readRowsThrottled(ctx, tbl, rr,
+		func(r bigtable.Row) bool {
+			sum.Rows++
+			var rd Reading
+			for fam, items := range r {
+				if fam == attrFamily {
+					continue
+				}
+				for _, it := range items {
+					_, col, _ := strings.Cut(it.Column, ":")
+					if err := decodeCell(&rd, col, it.Value); err != nil {
+						sum.SkippedCells++
+					}
+				}
+			}
+			if !rd.TempC.Valid {
+				return true
+			}
+
+			t := rd.TempC.Float64
+			sum.Count++
+			if sum.Count == 1 || t < sum.Min {
+				sum.Min = t
+			}
+			if sum.Count == 1 || t > sum.Max {
+				sum.Max = t
+			}
+			sum.Mean += (t - sum.Mean) / float64(sum.Count) // running mean
+			return true
+		},
+		bigtable.RowFilter(bigtable.LatestNFilter(1)),
+	)
+	if err != nil {
+		return sum, fmt.Errorf("tbl.ReadRows: %w", err)
+	}
+	return sum, nil
+}
+
+// streamRows scans rt in a goroutine and emits decoded Readings on the
+// returned channel, which is closed when the scan ends. At most one error
+// is delivered on the error channel; read it after the Reading channel closes.
+// Cancelling ctx stops the scan: the pending send is abandoned and the
+// ReadRows callback returns false, so the goroutine always exits.
+func streamRows(ctx context.Context, tbl *bigtable.Table, keys rowkey.Strategy, rt bigtable.RowSet, filter bigtable.Filter) (<-chan Reading, <-chan error) {
+	out := make(chan Reading)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(out)
+		defer close(errc)
+
+		err := scanRowsFunc(ctx, tbl, keys, rt, filter, func(rd Reading) error {
+			select {
+			case out <- rd:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil {
+			errc <- err
+		}
+	}()
+
+	return out, errc
+}
+
+// exportedReading is one line of exportJSONL output. Raw holds base64
+// values of cells that could not be decoded, keyed by column.
+type exportedReading struct {
+	Reading
+	Raw map[string]string `json:"raw,omitempty"`
+}
+
+// exportJSONL scans a prefix and writes each row as a JSON line to w,
+// taking the device and timestamp from the key as decoded by keys.
+// Undecodable cells are kept as base64 in "raw" instead of aborting the export.
+func exportJSONL(ctx context.Context, tbl *bigtable.Table, keys rowkey.Strategy, prefix string, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	n := 0
+
+	var writeErr error
+	err := readRowsThrottled(ctx, tbl, bigtable.PrefixRange(prefix),
+		func(r bigtable.Row) bool {
+			out := exportedReading{Reading: Reading{Key: r.Key()}}
+			if deviceID, ts, err := keys.Decode(r.Key()); err == nil {
+				out.DeviceID, out.Timestamp = deviceID, ts
+			}
+
+			for fam, items := range r {
+				for _, it := range items {
+					_, col, _ := strings.Cut(it.Column, ":")
+					if fam == attrFamily {
+						out.setAttr(col, it.Value)
+						continue
+					}
+					if err := decodeCell(&out.Reading, col, it.Value); err != nil {
+						if out.Raw == nil {
+							out.Raw = map[string]string{}
+						}
+						out.Raw[col] = base64.StdEncoding.EncodeToString(it.Value)
+					}
+				}
+			}
+
+			if writeErr = enc.Encode(out); writeErr != nil {
+				return false
+			}
+			n++
+			return true
+		},
+		bigtable.RowFilter(bigtable.LatestNFilter(1)),
+	)
+	if err != nil {
+		return n, fmt.Errorf("tbl.ReadRows: %w", err)
+	}
+	if writeErr != nil {
+		return n, fmt.Errorf("write JSON line: %w", writeErr)
+	}
+	return n, nil
+}
+
+// latestRowKey returns the key of the most recent row for a device. With
+// a newest-first layout that is the first row under its prefix; otherwise
+// the prefix is scanned in reverse.
+func latestRowKey(ctx context.Context, tbl *bigtable.Table, keys rowkey.Strategy, deviceID device.ID) (string, error) {
+	opts := []bigtable.ReadOption{
+		bigtable.LimitRows(1),
+		bigtable.RowFilter(bigtable.StripValueFilter()),
+	}
+	if !rowkey.NewestFirst(keys) {
+		opts = append(opts, bigtable.ReverseScan())
+	}
+
+	var key string
+	err := readRowsThrottled(ctx, tbl, bigtable.PrefixRange(keys.Prefix(deviceID)),
+		func(r bigtable.Row) bool {
+			key = r.Key()
+			return false // first row is the latest
+		},
+		opts...,
+	)
+	if err != nil {
+		return "", fmt.Errorf("tbl.ReadRows: %w", err)
+	}
+	if key == "" {
+		return "", fmt.Errorf("no rows found for device %q", deviceID)
+	}
+	return key, nil
+}
+
+// scanKeys returns the keys of the rows in rt, in key order, without their
+// data. The filter makes the server send a single cell per row with its
+// value stripped (a row with no cells wouldn't be returned at all), so
+// counting or listing rows costs a fraction of a full read. Cells are
+// still read server-side, so it is cheaper but not free.
+func scanKeys(ctx context.Context, tbl *bigtable.Table, rt bigtable.RowSet) ([]string, error) {
+	filter := bigtable.ChainFilters(bigtable.CellsPerRowLimitFilter(1), bigtable.StripValueFilter())
+
+	var keys []string
+	err := readRowsThrottled(ctx, tbl, rt,
+		func(r bigtable.Row) bool {
+			keys = append(keys, r.Key())
+			return true
+		},
+		bigtable.RowFilter(filter),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("tbl.ReadRows: %w", err)
+	}
+	return keys, nil
+}
+
+// listDevices returns up to limit device IDs (all if limit <= 0), sorted.
+// Rather than scan every reading it hops through the key space: read the
+// first key at or after start, decode its device, then jump past that
+// device's prefix. Each hop is a one-row, one-cell read with the value
+// stripped, so the cost grows with the number of devices, not readings.
+func listDevices(ctx context.Context, tbl *bigtable.Table, cfg Config, limit int) ([]device.ID, error) {
+	keys := cfg.keys()
+	filter := bigtable.ChainFilters(bigtable.CellsPerRowLimitFilter(1), bigtable.StripValueFilter())
+
+	var ids []device.ID
+	for start := ""; limit <= 0 || len(ids) < limit; {
+		var key string
+		err := readRowsThrottled(ctx, tbl, bigtable.InfiniteRange(start),
+			func(r bigtable.Row) bool {
+				key = r.Key()
+				return false
+			},
+			bigtable.LimitRows(1),
+			bigtable.RowFilter(filter),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("tbl.ReadRows: %w", err)
+		}
+		if key == "" {
+			break // past the last row
+		}
+
+		id, _, err := keys.Decode(key)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+		if start = prefixSuccessor(keys.Prefix(id)); start == "" {
+			break
+		}
+	}
+
+	// Sharded keys visit devices in shard order.
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// StaleDevice is a device whose latest reading is older than the
+// staleness threshold.
+type StaleDevice struct {
+	DeviceID device.ID
+	LastSeen time.Time
+	Age      time.Duration
+}
+
+// staleDevices returns the devices whose most recent reading is more than
+// threshold before now, oldest first. Each device costs a listDevices hop
+// plus one single-row, value-stripped read of its newest key (a reverse
+// scan for rowkey.Forward), so the check stays cheap however much history is
+// stored. Devices with no rows at all are unknown to the table and can't
+// be reported.
+func staleDevices(ctx context.Context, tbl *bigtable.Table, cfg Config, threshold time.Duration, now time.Time) ([]StaleDevice, error) {
+	keys := cfg.keys()
+	ids, err := listDevices(ctx, tbl, cfg, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []bigtable.ReadOption{
+		bigtable.LimitRows(1),
+		bigtable.RowFilter(bigtable.ChainFilters(bigtable.CellsPerRowLimitFilter(1), bigtable.StripValueFilter())),
+	}
+	if !rowkey.NewestFirst(keys) {
+		opts = append(opts, bigtable.ReverseScan())
+	}
+
+	var stale []StaleDevice
+	for _, id := range ids {
+		var key string
+		err := readRowsThrottled(ctx, tbl, bigtable.PrefixRange(keys.Prefix(id)),
+			func(r bigtable.Row) bool {
+				key = r.Key()
+				return false
+			},
+			opts...,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("tbl.ReadRows %s: %w", id, err)
+		}
+		if key == "" {
+			continue // deleted since listDevices saw it
+		}
+		_, ts, err := keys.Decode(key)
+		if err != nil {
+			return nil, err
+		}
+		if age := now.Sub(ts); age > threshold {
+			stale = append(stale, StaleDevice{DeviceID: id, LastSeen: ts, Age: age})
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].LastSeen.Before(stale[j].LastSeen) })
+	return stale, nil
+}
+
+// appendCell appends value to a column on the device's latest row using
+// ReadModifyWrite and returns the concatenated cell value. Unlike Increment,
+// AppendValue treats the cell as raw bytes, which suits audit trails.
+func appendCell(ctx context.Context, tbl *bigtable.Table, cfg Config, deviceID device.ID, column string, value []byte) ([]byte, error) {
+	key, err := latestRowKey(ctx, tbl, cfg.keys(), deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	rmw := bigtable.NewReadModifyWrite()
+	rmw.AppendValue(cfg.ColumnFamily, column, value)
+
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.write.rmw")
+	defer cancel()
+	r, err := tbl.ApplyReadModifyWrite(ctx, key, rmw)
+	if err != nil {
+		return nil, fmt.Errorf("tbl.ApplyReadModifyWrite: %w", ctxutil.Wrap(ctx, err))
+	}
+
+	// The returned row only contains the modified cell.
+	for _, it := range r[cfg.ColumnFamily] {
+		if it.Column == cfg.ColumnFamily+":"+column {
+			return it.Value, nil
+		}
+	}
+	return nil, fmt.Errorf("column %s missing from ReadModifyWrite result", column)
+}
+
+// ----------------------
+// Ingest pool
+// ----------------------
+
+// IngestConfig sets when an IngestPool flushes its buffer. Fields that
+// are zero or negative take the matching defaultIngestConfig value.
+type IngestConfig struct {
+	MaxRows       int           // flush when this many readings are buffered
+	MaxBytes      int           // ...or when their estimated size reaches this
+	FlushInterval time.Duration // ...or when this much time has passed
+	QueueSize     int           // Add blocks once this many readings are queued
+}
+
+// Flush thresholds used for unset IngestConfig fields
+var defaultIngestConfig = IngestConfig{
+	MaxRows:       500,
+	MaxBytes:      1 << 20,
+	FlushInterval: time.Second,
+	QueueSize:     1000,
+}
+
+// Replace unset (non-positive) fields with defaultIngestConfig's. A zero
+// FlushInterval would panic in time.NewTicker, zero MaxRows or MaxBytes
+// would flush on every Add, and a zero QueueSize would make Add wait for
+// the flush loop.
+func (ic IngestConfig) withDefaults() IngestConfig {
+	d := defaultIngestConfig
+	if ic.MaxRows <= 0 {
+		ic.MaxRows = d.MaxRows
+	}
+	if ic.MaxBytes <= 0 {
+		ic.MaxBytes = d.MaxBytes
+	}
+	if ic.FlushInterval <= 0 {
+		ic.FlushInterval = d.FlushInterval
+	}
+	if ic.QueueSize <= 0 {
+		ic.QueueSize = d.QueueSize
+	}
+	return ic
+}
+
+// errPoolClosed is returned by IngestPool.Add after Close.
+var errPoolClosed = errors.New("ingest pool closed")
+
+// IngestPool buffers Readings and writes them with ApplyBulk in batches.
+// Add blocks when the queue is full, which pushes back on fast producers.
+type IngestPool struct {
+	tbl  *bigtable.Table
+	cfg  Config
+	opts WriteOptions
+	ic   IngestConfig
+
+	in   chan Reading
+	done chan struct{}
+
+	// closeMu guards closed and the close of in: Add holds it shared while
+	// sending, so Close can't close in under a pending send.
+	closeMu sync.RWMutex
+	closed  bool
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// newIngestPool starts the pool's flush loop. Call Close to drain it.
+func newIngestPool(ctx context.Context, tbl *bigtable.Table, cfg Config, opts WriteOptions, ic IngestConfig) *IngestPool {
+	ic = ic.withDefaults()
+	p := &IngestPool{
+		tbl:  tbl,
+		cfg:  cfg,
+		opts: opts,
+		ic:   ic,
+		in:   make(chan Reading, ic.QueueSize),
+		done: make(chan struct{}),
+	}
+	go p.run(ctx)
+	return p
+}
+
+// Add queues a reading, blocking while the queue is full. After Close it
+// returns errPoolClosed.
+func (p *IngestPool) Add(ctx context.Context, rd Reading) error {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		return errPoolClosed
+	}
+	select {
+	case p.in <- rd:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting readings, flushes everything still buffered and
+// returns the joined errors of all failed writes. Calling it again only
+// returns those errors.
+func (p *IngestPool) Close() error {
+	p.closeMu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.in)
+	}
+	p.closeMu.Unlock()
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return errors.Join(p.errs...)
+}
+
+func (p *IngestPool) run(ctx context.Context) {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.ic.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []Reading
+	size := 0
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := writeRows(ctx, p.tbl, p.cfg, batch, p.opts); err != nil {
+			p.mu.Lock()
+			p.errs = append(p.errs, err)
+			p.mu.Unlock()
+		}
+		batch, size = nil, 0
+	}
+
+	for {
+		select {
+		case rd, ok := <-p.in:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, rd)
+			size += readingSize(rd)
+			if len(batch) >= p.ic.MaxRows || size >= p.ic.MaxBytes {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Rough mutation size of a reading: key plus column names and values
+func readingSize(rd Reading) int {
+	const keyLen = 21 // '#' + up to 20 digits of reversed millis
+	return len(rd.DeviceID) + keyLen +
+		len("temp_c") + len(rd.TempC.String()) +
+		len("hum_pct") + len(rd.HumidityPct.String())
+}
+
+// ----------------------
+// Reconciliation
+// ----------------------
+
+// CountMismatch is a device whose row counts differ between the stores.
+type CountMismatch struct {
+	DeviceID device.ID
+	Bigtable int64
+	BigQuery int64
+}
+
+// reconcile compares per-device row counts for readings observed in
+// [since, until) between Bigtable and a BigQuery table ("dataset.table")
+// fed by the same dual-write pipeline, returning the devices that differ.
+//
+// BigQuery queries see streamed rows within seconds, but the pipeline's two
+// writes don't land at the same instant, so until should trail now by a
+// settle period (a few minutes) or recent rows show up as false
+// mismatches. Bigtable keys start with the device (or its shard), not the
+// time, so its side is a key-only scan of the whole table filtered by the
+// timestamp keys decodes from each key.
+func reconcile(ctx context.Context, btTbl *bigtable.Table, keys rowkey.Strategy, bqClient *bigquery.Client, bqTable string, since, until time.Time) ([]CountMismatch, error) {
+	datasetID, tableID, err := events.SplitTable(bqTable)
+	if err != nil {
+		return nil, err
+	}
+
+	btCounts := map[device.ID]int64{}
+	err = readRowsThrottled(ctx, btTbl, bigtable.InfiniteRange(""),
+		func(r bigtable.Row) bool {
+			id, ts, err := keys.Decode(r.Key())
+			if err == nil && !ts.Before(since) && ts.Before(until) {
+				btCounts[id]++
+			}
+			return true
+		},
+		bigtable.RowFilter(bigtable.ChainFilters(bigtable.CellsPerRowLimitFilter(1), bigtable.StripValueFilter())),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("bigtable scan: %w", err)
+	}
+
+	q := bqClient.Query(fmt.Sprintf(`
+		SELECT device_id, COUNT(*) AS n
+		FROM %s
+		WHERE timestamp >= @since AND timestamp < @until
+		GROUP BY device_id`, fmt.Sprintf("`%s.%s.%s`", bqClient.Project(), datasetID, tableID)))
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "since", Value: since},
+		{Name: "until", Value: until},
+	}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("bigquery query: %w", err)
+	}
+
+	bqCounts := map[device.ID]int64{}
+	for {
+		var row struct {
+			DeviceID string `bigquery:"device_id"`
+			N        int64  `bigquery:"n"`
+		}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bigquery results: %w", err)
+		}
+		bqCounts[device.ID(row.DeviceID)] = row.N
+	}
+
+	var out []CountMismatch
+	for id, n := range btCounts {
+		if bqCounts[id] != n {
+			out = append(out, CountMismatch{DeviceID: id, Bigtable: n, BigQuery: bqCounts[id]})
+		}
+	}
+	for id, n := range bqCounts {
+		if _, ok := btCounts[id]; !ok {
+			out = append(out, CountMismatch{DeviceID: id, BigQuery: n})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DeviceID < out[j].DeviceID })
+	return out, nil
+}
+
+// DeviceView is one device's combined view: its latest reading from
+// Bigtable (the hot store) next to aggregates of its history from BigQuery
+// (the cold store). Latest is nil for a device only BigQuery knows, e.g.
+// one whose hot rows have aged out; Events is zero and AvgTemp NULL for a
+// device only Bigtable knows, e.g. one not exported yet.
+type DeviceView struct {
+	DeviceID device.ID
+	Latest   *Reading
+	Events   int64
+	AvgTemp  bigquery.NullFloat64
+}
+
+// deviceOverview joins the latest Bigtable reading of every device with
+// its event count and average temperature since since from a BigQuery
+// table ("dataset.table"), sorted by device. The join happens in memory:
+// the stores can't be queried together. Finding each device's latest row
+// takes one single-row read per device: its first row under a newest-first
+// key layout, or a reverse scan's first row otherwise, as in staleDevices.
+func deviceOverview(ctx context.Context, btTbl *bigtable.Table, cfg Config, bqClient *bigquery.Client, bqTable string, since time.Time) ([]DeviceView, error) {
+	datasetID, tableID, err := events.SplitTable(bqTable)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []bigtable.ReadOption{
+		bigtable.LimitRows(1),
+		bigtable.RowFilter(bigtable.LatestNFilter(1)),
+	}
+	if !rowkey.NewestFirst(cfg.keys()) {
+		opts = append(opts, bigtable.ReverseScan())
+	}
+
+	views := map[device.ID]*DeviceView{}
+	ids, err := listDevices(ctx, btTbl, cfg, 0)
+	if err != nil {
+		return nil, fmt.Errorf("bigtable devices: %w", err)
+	}
+	for _, id := range ids {
+		var latest *Reading
+		var decodeErr error
+		err := readRowsThrottled(ctx, btTbl, bigtable.PrefixRange(cfg.keys().Prefix(id)),
+			func(r bigtable.Row) bool {
+				rd, err := decodeReading(r, cfg.keys())
+				latest, decodeErr = &rd, err
+				return false
+			},
+			opts...,
+		)
+		if err == nil {
+			err = decodeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bigtable latest %s: %w", id, err)
+		}
+		views[id] = &DeviceView{DeviceID: id, Latest: latest}
+	}
+
+	q := bqClient.Query(fmt.Sprintf(`
+		SELECT device_id, COUNT(*) AS events, AVG(temperature) AS avg_temp
+		FROM %s
+		WHERE timestamp >= @since
+		GROUP BY device_id`, fmt.Sprintf("`%s.%s.%s`", bqClient.Project(), datasetID, tableID)))
+	q.Parameters = []bigquery.QueryParameter{{Name: "since", Value: since}}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("bigquery query: %w", err)
+	}
+	for {
+		var row struct {
+			DeviceID string               `bigquery:"device_id"`
+			Events   int64                `bigquery:"events"`
+			AvgTemp  bigquery.NullFloat64 `bigquery:"avg_temp"`
+		}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bigquery results: %w", err)
+		}
+		id := device.ID(row.DeviceID)
+		v, ok := views[id]
+		if !ok {
+			v = &DeviceView{DeviceID: id}
+			views[id] = v
+		}
+		v.Events, v.AvgTemp = row.Events, row.AvgTemp
+	}
+
+	out := make([]DeviceView, 0, len(views))
+	for _, v := range views {
+		out = append(out, *v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DeviceID < out[j].DeviceID })
+	return out, nil
+}
+
+// replayBatch is how many events replayToBigtable sends per writeRows call.
+const replayBatch = 1000
+
+// replayToBigtable rehydrates Bigtable from the analytics copy: it reads
+// every event observed since since from a BigQuery table ("dataset.table")
+// and writes it with writeRows, so keys are encoded from the event's own
+// timestamp and cells carry that timestamp, exactly as the original write
+// did. Rewriting a row that still exists replaces its cells in place, so a
+// replay can be rerun. BigQuery has no humidity, so replayed rows have only
+// temp_c, and two events of one device in the same millisecond collapse
+// into one row, as they would have on the live path.
+//
+// Progress is printed after each batch. Events with invalid device IDs and
+// rows Bigtable rejects don't stop the replay; they are joined into the
+// returned error alongside the count of readings written.
+func replayToBigtable(ctx context.Context, bqClient *bigquery.Client, bqTable string, btTbl *bigtable.Table, cfg Config, since time.Time) (int, error) {
+	datasetID, tableID, err := events.SplitTable(bqTable)
+	if err != nil {
+		return 0, err
+	}
+	q := bqClient.Query(fmt.Sprintf(`
+		SELECT device_id, timestamp, temperature
+		FROM %s
+		WHERE timestamp >= @since
+		ORDER BY timestamp`, fmt.Sprintf("`%s.%s.%s`", bqClient.Project(), datasetID, tableID)))
+	q.Parameters = []bigquery.QueryParameter{{Name: "since", Value: since}}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("bigquery query: %w", err)
+	}
+
+	var (
+		errs    []error
+		batch   []Reading
+		written int
+	)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := writeRows(ctx, btTbl, cfg, batch, WriteOptions{})
+		if err == nil {
+			written += len(batch)
+		} else if rowErrs, ok := err.(interface{ Unwrap() []error }); ok {
+			written += len(batch) - len(rowErrs.Unwrap()) // only some rows failed
+			errs = append(errs, err)
+		} else {
+			errs = append(errs, err)
+		}
+		fmt.Printf("Replayed %d of %d events\n", written, it.TotalRows)
+		batch = batch[:0]
+	}
+
+	for {
+		var row struct {
+			DeviceID    string               `bigquery:"device_id"`
+			Timestamp   time.Time            `bigquery:"timestamp"`
+			Temperature bigquery.NullFloat64 `bigquery:"temperature"`
+		}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			flush()
+			return written, errors.Join(append(errs, fmt.Errorf("bigquery results: %w", err))...)
+		}
+
+		id, err := device.NewID(row.DeviceID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		batch = append(batch, Reading{
+			DeviceID:  id,
+			Timestamp: row.Timestamp,
+			TempC:     NullFloat64{Float64: row.Temperature.Float64, Valid: row.Temperature.Valid},
+		})
+		if len(batch) == replayBatch {
+			flush()
+		}
+	}
+	flush()
+
+	return written, errors.Join(errs...)
+}
+
+// ----------------------
+// Migration
+// ----------------------
+
+// copyBatch is how many rows copyRows sends per ApplyBulk.
+const copyBatch = 500
+
+// CopyStats summarises a copyRows run.
+type CopyStats struct {
+	Rows   int // rows read from the source
+	Cells  int // cells written to the destination
+	Failed int // rows the destination rejected
+}
+
+// copyRows copies the rows in rt from srcTbl to dstTbl, writing every cell
+// that passes filter with its original family, column and timestamp, so
+// the destination holds the same versions as the source. A nil filter copies
+// all versions; bigtable.LatestNFilter(1) copies only current values. The
+// destination must already have the source's column families.
+//
+// Rows are sent with ApplyBulk in batches of copyBatch and progress is
+// printed after each one. Rows rejected by the destination don't stop the
+// copy; they are counted and joined into the returned error. A failed
+// batch request or scan aborts it, and rerunning is safe because rewriting
+// a cell with the same timestamp replaces it.
+func copyRows(ctx context.Context, srcTbl, dstTbl *bigtable.Table, rt bigtable.RowSet, filter bigtable.Filter) (CopyStats, error) {
+	var (
+		stats   CopyStats
+		errs    []error
+		keys    []string
+		muts    []*bigtable.Mutation
+		bulkErr error
+	)
+	flush := func() {
+		if len(keys) == 0 {
+			return
+		}
+		bctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.write.bulk")
+		defer cancel()
+		rowErrs, err := dstTbl.ApplyBulk(bctx, keys, muts)
+		if err != nil {
+			bulkErr = fmt.Errorf("dstTbl.ApplyBulk: %w", ctxutil.Wrap(bctx, asThrottled(err)))
+			return
+		}
+		for i, rowErr := range rowErrs {
+			if rowErr != nil {
+				stats.Failed++
+				errs = append(errs, fmt.Errorf("row %s: %w", keys[i], rowErr))
+			}
+		}
+		fmt.Printf("Copied %d rows (%d cells, %d failed)\n", stats.Rows, stats.Cells, stats.Failed)
+		keys, muts = keys[:0], muts[:0]
+	}
+
+	var opts []bigtable.ReadOption
+	if filter != nil {
+		opts = append(opts, bigtable.RowFilter(filter))
+	}
+	err := readRowsThrottled(ctx, srcTbl, rt, func(r bigtable.Row) bool {
+		mut := bigtable.NewMutation()
+		for fam, items := range r {
+			for _, it := range items {
+				// ReadItem.Column is "family:qualifier".
+				mut.Set(fam, strings.TrimPrefix(it.Column, fam+":"), it.Timestamp, it.Value)
+				stats.Cells++
+			}
+		}
+		stats.Rows++
+		keys = append(keys, r.Key())
+		muts = append(muts, mut)
+		if len(keys) == copyBatch {
+			flush()
+		}
+		return bulkErr == nil
+	}, opts...)
+	if err == nil && bulkErr == nil {
+		flush()
+	}
+	if err != nil {
+		return stats, fmt.Errorf("source scan: %w", err)
+	}
+	if bulkErr != nil {
+		return stats, bulkErr
+	}
+	return stats, errors.Join(errs...)
+}
+
+// ----------------------
+// Decommissioning
+// ----------------------
+
+// deleteBatch is how many rows deleteDevice deletes per ApplyBulk.
+const deleteBatch = 1000
+
+// deleteDevice deletes every row of deviceID, returning how many were
+// deleted. It scans the device's prefix for keys (one value-stripped cell
+// per row) and sends DeleteRow mutations with ApplyBulk in batches of
+// deleteBatch. Rows that fail to delete don't stop it; they are joined into
+// the returned error and not counted. Deleting is idempotent, so rerunning
+// after a failure is safe.
+//
+// The cost grows with the device's row count. For large devices prefer
+// dropDevice, which deletes the whole range server-side in one call.
+func deleteDevice(ctx context.Context, tbl *bigtable.Table, cfg Config, deviceID device.ID) (int, error) {
+	var (
+		deleted int
+		errs    []error
+		keys    []string
+		bulkErr error
+	)
+	flush := func() {
+		if len(keys) == 0 {
+			return
+		}
+		muts := make([]*bigtable.Mutation, len(keys))
+		for i := range muts {
+			muts[i] = bigtable.NewMutation()
+			muts[i].DeleteRow()
+		}
+		bctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.write.bulk")
+		defer cancel()
+		rowErrs, err := tbl.ApplyBulk(bctx, keys, muts)
+		if err != nil {
+			bulkErr = fmt.Errorf("tbl.ApplyBulk: %w", ctxutil.Wrap(bctx, asThrottled(err)))
+			return
+		}
+		deleted += len(keys)
+		for i, rowErr := range rowErrs {
+			if rowErr != nil {
+				deleted--
+				errs = append(errs, fmt.Errorf("row %s: %w", keys[i], rowErr))
+			}
+		}
+		keys = keys[:0]
+	}
+
+	filter := bigtable.ChainFilters(bigtable.CellsPerRowLimitFilter(1), bigtable.StripValueFilter())
+	err := readRowsThrottled(ctx, tbl, bigtable.PrefixRange(cfg.keys().Prefix(deviceID)),
+		func(r bigtable.Row) bool {
+			keys = append(keys, r.Key())
+			if len(keys) == deleteBatch {
+				flush()
+			}
+			return bulkErr == nil
+		},
+		bigtable.RowFilter(filter),
+	)
+	if err == nil && bulkErr == nil {
+		flush()
+	}
+	if err != nil {
+		return deleted, fmt.Errorf("scan: %w", err)
+	}
+	if bulkErr != nil {
+		return deleted, bulkErr
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// dropDevice deletes every row of deviceID with the admin DropRowRange
+// call: one request however many rows there are, with the work done
+// server-side, so it is much faster than deleteDevice for large devices.
+// It needs admin rights (bigtable.tables.update) rather than data access,
+// doesn't report how many rows it removed, and can't be retried per row.
+// Like every admin call it is meant for occasional use, not a hot path.
+func dropDevice(ctx context.Context, admin *bigtable.AdminClient, cfg Config, deviceID device.ID) error {
+	if err := admin.DropRowRange(ctx, cfg.TableID, cfg.keys().Prefix(deviceID)); err != nil {
+		return fmt.Errorf("admin.DropRowRange: %w", err)
+	}
+	return nil
+}
+
+// ----------------------
+// Current state
+// ----------------------
+
+// stateFamily holds each device's current metrics in a current-state
+// table; create it with ensureStateFamily.
+const stateFamily = "state"
+
+// upsertReadings records readings in a current-state table: one row per
+// device, keyed by its bare ID, with one fixed column per metric. Unlike
+// the time-series layout, where every reading is a new row, a write here
+// replaces the metric's previous value. Each cell is stamped with the
+// reading's time and the family keeps one version, so the newest reading
+// wins even if an older one arrives later, and retries are idempotent. A
+// metric missing from a reading leaves its stored value in place. Rows
+// are sent in one ApplyBulk; rejected rows are joined into the error.
+//
+// Use a table of its own: bare device keys don't decode as readings, so
+// they would break scans of a time-series table.
+func upsertReadings(ctx context.Context, tbl *bigtable.Table, cfg Config, readings []Reading) error {
+	var keys []string
+	var muts []*bigtable.Mutation
+	for _, rd := range readings {
+		ts := bigtable.Time(rd.Timestamp).TruncateToMilliseconds()
+		mut := bigtable.NewMutation()
+		n := 0
+		for col, v := range map[string]NullFloat64{"temp_c": rd.TempC, "hum_pct": rd.HumidityPct} {
+			if v.Valid {
+				mut.Set(stateFamily, col, ts, []byte(v.String()))
+				n++
+			}
+		}
+		if n == 0 {
+			continue // nothing to record
+		}
+		keys = append(keys, string(rd.DeviceID))
+		muts = append(muts, mut)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.write.bulk")
+	defer cancel()
+	rowErrs, err := tbl.ApplyBulk(ctx, keys, muts)
+	if err != nil {
+		return fmt.Errorf("tbl.ApplyBulk: %w", ctxutil.Wrap(ctx, asThrottled(err)))
+	}
+	var errs []error
+	for i, rowErr := range rowErrs {
+		if rowErr != nil {
+			errs = append(errs, fmt.Errorf("row %s: %w", keys[i], rowErr))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Read a device's current state from a current-state table. Timestamp is
+// that of the newest metric. Garbage collection of the versions beyond
+// the first is lazy, so the read still asks for the latest cell only.
+func readCurrentState(ctx context.Context, tbl *bigtable.Table, deviceID device.ID) (Reading, error) {
+	filter := bigtable.ChainFilters(
+		bigtable.FamilyFilter(regexp.QuoteMeta(stateFamily)),
+		bigtable.LatestNFilter(1),
+	)
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.read.row")
+	defer cancel()
+	r, err := tbl.ReadRow(ctx, string(deviceID), bigtable.RowFilter(filter))
+	if err != nil {
+		return Reading{}, fmt.Errorf("tbl.ReadRow: %w", ctxutil.Wrap(ctx, err))
+	}
+	if r == nil {
+		return Reading{}, fmt.Errorf("no state for device %q", deviceID)
+	}
+
+	rd := Reading{Key: r.Key(), DeviceID: deviceID}
+	for _, it := range r[stateFamily] {
+		_, col, _ := strings.Cut(it.Column, ":")
+		if err := decodeCell(&rd, col, it.Value); err != nil {
+			return Reading{}, fmt.Errorf("row %s: %s: %w", r.Key(), col, err)
+		}
+		if t := it.Timestamp.Time(); t.After(rd.Timestamp) {
+			rd.Timestamp = t
+		}
+	}
+	return rd, nil
+}
+
+// ----------------------
+// Counters
+// ----------------------
+
+// counterFamily is the sum-aggregate family holding counters; create it
+// with ensureSumFamily.
+const counterFamily = "totals"
+
+// Add deltas to the counter columns of row key with AddToCell, in one write.
+// Bigtable sums each delta into the cell server-side, so concurrent
+// writers never lose an update and nothing is read first. Deltas with the
+// same bucket time accumulate into one cell; a new bucket (e.g. the day,
+// truncated) starts a new cell, keeping a per-bucket history that GC
+// policies can age out. Additions are not idempotent, so they are never
+// retried: a retry after a lost response would count twice.
+func addToCounters(ctx context.Context, tbl *bigtable.Table, key string, deltas map[string]int64, bucket time.Time) error {
+	ts := bigtable.Time(bucket).TruncateToMilliseconds()
+	mut := bigtable.NewMutation()
+	for col, d := range deltas {
+		mut.AddIntToCell(counterFamily, col, ts, d)
+	}
+	return applyThrottled(ctx, tbl, key, mut)
+}
+
+// Read the counters of row key, summing every bucket of each column.
+// Sum cells hold their total as an 8-byte big-endian int64.
+func readCounters(ctx context.Context, tbl *bigtable.Table, key string) (map[string]int64, error) {
+	ctx, cancel := ctxutil.WithOperationTimeout(ctx, "bigtable.read.row")
+	defer cancel()
+	r, err := tbl.ReadRow(ctx, key, bigtable.RowFilter(bigtable.FamilyFilter(regexp.QuoteMeta(counterFamily))))
+	if err != nil {
+		return nil, fmt.Errorf("tbl.ReadRow: %w", ctxutil.Wrap(ctx, err))
+	}
+
+	totals := map[string]int64{}
+	for _, it := range r[counterFamily] {
+		if len(it.Value) != 8 {
+			return nil, fmt.Errorf("%s: %d-byte value is not a sum cell", it.Column, len(it.Value))
+		}
+		_, col, _ := strings.Cut(it.Column, ":")
+		totals[col] += int64(binary.BigEndian.Uint64(it.Value))
+	}
+	return totals, nil
+}
+
+// ----------------------
+// Replication
+// ----------------------
 
-	readRow(ctx, tbl, rowKey)
+// Create (or keep) an app profile that routes every request to one cluster.
+// On a replicated instance the default profile may send a write to one
+// cluster and the next read to another, hiding replication entirely; pinning
+// a writer and a reader to different clusters makes it observable.
+func ensureSingleClusterProfile(ctx context.Context, iac *bigtable.InstanceAdminClient, instanceID, profileID, clusterID string) error {
+	_, err := iac.CreateAppProfile(ctx, bigtable.ProfileConf{
+		ProfileID:      profileID,
+		InstanceID:     instanceID,
+		Description:    "go-handbook: single-cluster routing to " + clusterID,
+		RoutingConfig:  &bigtable.SingleClusterRoutingConfig{ClusterID: clusterID},
+		IgnoreWarnings: true, // single-cluster profiles on replicated instances warn
+	})
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("CreateAppProfile %s: %w", profileID, err)
+	}
+	return nil
+}
+
+// Create a data client whose requests all use the given app profile
+func createProfileClient(ctx context.Context, cfg Config, profileID string) (*bigtable.Client, error) {
+	opts, err := bigtableClientOptions(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := bigtable.NewClientWithConfig(ctx, cfg.ProjectID, cfg.InstanceID,
+		bigtable.ClientConfig{AppProfile: profileID}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("bigtable.NewClientWithConfig(%s): %w", profileID, err)
+	}
+	return client, nil
+}
+
+// measureReplicationLag writes a probe cell through writeTbl and polls
+// readTbl until the same value is visible, returning the time from the
+// write's acknowledgement to the first read that saw it. Open the two
+// tables from clients on single-cluster profiles for different clusters.
+// Replication is asynchronous and usually takes seconds, but there is no
+// upper bound, hence timeout. The result overstates the lag by up to one
+// poll interval. The probe row is deleted afterwards.
+func measureReplicationLag(ctx context.Context, writeTbl, readTbl *bigtable.Table, cfg Config, timeout time.Duration) (time.Duration, error) {
+	const poll = 50 * time.Millisecond
+
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, fmt.Errorf("rand.Read: %w", err)
+	}
+	token := hex.EncodeToString(b[:])
+	key := "replication-probe#" + token
+
+	mut := bigtable.NewMutation()
+	mut.Set(cfg.ColumnFamily, "probe", bigtable.Now(), []byte(token))
+	if err := applyThrottled(ctx, writeTbl, key, mut); err != nil {
+		return 0, fmt.Errorf("write probe: %w", err)
+	}
+	written := time.Now()
+	defer func() {
+		del := bigtable.NewMutation()
+		del.DeleteRow()
+		if err := writeTbl.Apply(context.WithoutCancel(ctx), key, del); err != nil {
+			log.Printf("Failed to delete probe row %s: %v", key, err)
+		}
+	}()
+
+	filter := bigtable.ChainFilters(
+		bigtable.FamilyFilter(regexp.QuoteMeta(cfg.ColumnFamily)),
+		bigtable.ColumnFilter("probe"),
+		bigtable.LatestNFilter(1),
+	)
+	for {
+		r, err := readTbl.ReadRow(ctx, key, bigtable.RowFilter(filter))
+		if err != nil {
+			return 0, fmt.Errorf("read probe: %w", err)
+		}
+		for _, it := range r[cfg.ColumnFamily] {
+			if string(it.Value) == token {
+				return time.Since(written), nil
+			}
+		}
+		if time.Since(written) > timeout {
+			return 0, fmt.Errorf("probe not replicated after %v", timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+// ----------------------
+// Admin operations
+// ----------------------
+
+// Create and return a Bigtable admin client
+func createAdminClient(ctx context.Context, cfg Config) *bigtable.AdminClient {
+	opts, err := bigtableClientOptions(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Failed to resolve credentials: %v", err)
+	}
+
+	admin, err := bigtable.NewAdminClient(ctx, cfg.ProjectID, cfg.InstanceID, opts...)
+	if err != nil {
+		log.Fatalf("Failed to create Bigtable admin client: %v", err)
+	}
+	return admin
+}
+
+// List the tables in the instance
+func listTables(ctx context.Context, admin *bigtable.AdminClient) ([]string, error) {
+	tables, err := admin.Tables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin.Tables: %w", err)
+	}
+	return tables, nil
+}
+
+// ttlFamily is the column family used by the TTL demo, so its short max-age
+// policy never touches the main family's data.
+const ttlFamily = "ttl_demo"
+
+// Create family unless the table already has it
+func ensureFamily(ctx context.Context, admin *bigtable.AdminClient, tableID, family string) error {
+	err := admin.CreateColumnFamily(ctx, tableID, family)
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("CreateColumnFamily %s: %w", family, err)
+	}
+	return nil
+}
+
+// Create stateFamily with a one-version GC policy unless the table already
+// has it
+func ensureStateFamily(ctx context.Context, admin *bigtable.AdminClient, tableID string) error {
+	if err := ensureFamily(ctx, admin, tableID, stateFamily); err != nil {
+		return err
+	}
+	if err := admin.SetGCPolicy(ctx, tableID, stateFamily, bigtable.MaxVersionsPolicy(1)); err != nil {
+		return fmt.Errorf("SetGCPolicy %s: %w", stateFamily, err)
+	}
+	return nil
+}
+
+// Create family as an int64 sum-aggregate family unless the table already
+// has it. Such a family only accepts AddToCell mutations, not Set, and an
+// existing plain family of the same name is left as it is, so use a name
+// of its own.
+func ensureSumFamily(ctx context.Context, admin *bigtable.AdminClient, tableID, family string) error {
+	err := admin.CreateColumnFamilyWithConfig(ctx, tableID, family, bigtable.Family{
+		ValueType: bigtable.AggregateType{Input: bigtable.Int64Type{}, Aggregator: bigtable.SumAggregator{}},
+	})
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("CreateColumnFamilyWithConfig %s: %w", family, err)
+	}
+	return nil
+}
+
+// describeTable returns a table's column families with their GC policies.
+func describeTable(ctx context.Context, admin *bigtable.AdminClient, tableID string) ([]bigtable.FamilyInfo, error) {
+	info, err := admin.TableInfo(ctx, tableID)
+	if err != nil {
+		return nil, fmt.Errorf("admin.TableInfo(%s): %w", tableID, err)
+	}
+	return info.FamilyInfos, nil
+}
+
+// createBackup backs up the configured table to a cluster and waits for the
+// long-running operation to finish. The backup is deleted after ttl.
+func createBackup(ctx context.Context, admin *bigtable.AdminClient, cfg Config, clusterID, backupID string, ttl time.Duration) (*bigtable.BackupInfo, error) {
+	fmt.Printf("Backing up %s to %s/%s...\n", cfg.TableID, clusterID, backupID)
+	if err := admin.CreateBackup(ctx, cfg.TableID, clusterID, backupID, time.Now().Add(ttl)); err != nil {
+		return nil, fmt.Errorf("admin.CreateBackup: %w", err)
+	}
+
+	info, err := admin.BackupInfo(ctx, clusterID, backupID)
+	if err != nil {
+		return nil, fmt.Errorf("admin.BackupInfo: %w", err)
+	}
+	return info, nil
+}
+
+// restoreBackup restores a backup into a new table, waiting for the
+// operation to finish. The destination table must not exist yet.
+func restoreBackup(ctx context.Context, admin *bigtable.AdminClient, clusterID, backupID, tableID string) error {
+	fmt.Printf("Restoring %s/%s into %s...\n", clusterID, backupID, tableID)
+	if err := admin.RestoreTable(ctx, tableID, clusterID, backupID); err != nil {
+		return fmt.Errorf("admin.RestoreTable: %w", err)
+	}
+	return nil
+}
+
+// ----------------------
+// Main
+// ----------------------
+func main() {
+	describe := flag.Bool("describe", false, "list tables and their column families, then exit")
+	clusterID := flag.String("cluster", "", "cluster ID used by --backup and --restore-to")
+	replication := flag.String("replication", "", "measure replication lag from one cluster to another, given as WRITE_CLUSTER,READ_CLUSTER, then exit")
+	backupID := flag.String("backup", "", "back up the table to this backup ID (kept 7 days), then exit")
+	restoreTo := flag.String("restore-to", "", "with --backup, restore that backup into this new table instead")
+	ingest := flag.Int("ingest", 0, "write this many synthetic readings through the ingest pool")
+	backfill := flag.String("backfill", "", "write historical readings from this CSV (deviceID,timestamp,temp_c,hum_pct), then exit")
+	alertAbove := flag.Float64("alert-above", 0, "set an expiring alert marker on the written row if its temperature is above this (0 disables)")
+	versions := flag.Int("versions", 0, "debug: print up to this many versions per column of the written row")
+	exportTo := flag.String("export-bq", "", "stream sensor-42's readings into this BigQuery dataset.table, then exit")
+	replayFrom := flag.String("replay-from", "", "rewrite readings from this BigQuery dataset.table into Bigtable, then exit")
+	replaySince := flag.Duration("replay-since", 24*time.Hour, "with --replay-from, how far back to replay")
+	overviewFrom := flag.String("overview", "", "print each device's latest reading next to its last-day average from this BigQuery dataset.table, then exit")
+	reconcileWith := flag.String("reconcile", "", "compare per-device counts for the last day with this BigQuery dataset.table, then exit")
+	ttlDemo := flag.Duration("ttl-demo", 0, "write a reading into a family with this max-age and wait for it to expire (use the emulator), then exit")
+	deleteID := flag.String("delete-device", "", "delete every row of this device, then exit")
+	dropRange := flag.Bool("drop-range", false, "with --delete-device, delete server-side with the admin DropRowRange call instead of per-row deletes")
+	firstLast := flag.Bool("first-last", false, "correct the sample row's temperature, then print its first-written and current values")
+	stateTable := flag.String("state-table", "", "upsert sample readings into this current-state table, print the device's state, then exit")
+	countTo := flag.String("count-to", "", "count sample events per device in this table's sum-aggregate family, print the totals, then exit")
+	copyTo := flag.String("copy-to", "", "copy every row with all its versions into this table in the same instance, then exit")
+	keyRange := flag.String("range", "", "print readings with keys in [START,END) given as START,END, then exit")
+	asOf := flag.String("as-of", "", "print the row KEY as it was at TIME, given as KEY@RFC3339-TIME, then exit")
+	amplification := flag.String("amplification", "", "compare read amplification of client- and server-side filtering for temp_c > 27 under this prefix, then exit")
+	maxCells := flag.Int("max-cells", 0, "read at most this many cells per row in the prefix scan (0 = all)")
+	scanBudget := flag.Duration("scan-budget", 200*time.Millisecond, "latency budget for the best-effort partial scan")
+	serverTime := flag.Bool("server-time", false, "let Bigtable assign cell timestamps (bigtable.ServerTime)")
+	maxSkew := flag.Duration("max-skew", 0, "reject readings whose timestamp is further than this from now (0 disables)")
+	clampSkew := flag.Bool("clamp-skew", false, "with --max-skew, write skewed readings with clamped timestamps instead of rejecting them")
+	packed := flag.Bool("packed", false, "store each row's metrics as one JSON cell instead of a cell per metric")
+	protoCells := flag.Bool("proto", false, "store each row's metrics as one protobuf cell (takes precedence over --packed)")
+	keysPrefix := flag.String("keys", "", "print the row keys under this prefix and their count, then exit")
+	devices := flag.Int("devices", 0, "print up to this many device IDs found in the table, then exit")
+	staleAfter := flag.Duration("stale", 0, "log devices with no reading for longer than this, then exit (status 1 if any)")
+	attrsFlag := flag.String("attrs", "", "device attributes written with the sample readings, given as name=value,... (e.g. fw=1.4.2,site=lab)")
+	flag.Parse()
+
+	// Load configuration
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctxutil.SetTimeout("bigtable.write", cfg.WriteTimeout)
+	ctxutil.SetTimeout("bigtable.read", cfg.ReadTimeout)
+	writeOpts := WriteOptions{ServerTimestamp: *serverTime, Packed: *packed, Proto: *protoCells, MaxSkew: *maxSkew, ClampSkew: *clampSkew}
+
+	ctx := context.Background()
+	client := createBigtableClient(ctx, cfg)
+	defer client.Close()
+
+	if *describe {
+		admin := createAdminClient(ctx, cfg)
+		defer admin.Close()
+
+		tables, err := listTables(ctx, admin)
+		if err != nil {
+			log.Fatalf("Failed to list tables: %v", err)
+		}
+		for _, t := range tables {
+			fmt.Println("Table:", t)
+			families, err := describeTable(ctx, admin, t)
+			if err != nil {
+				log.Fatalf("Failed to describe table: %v", err)
+			}
+			for _, f := range families {
+				fmt.Printf("  Family: %s, GC: %s\n", f.Name, f.GCPolicy)
+			}
+		}
+		return
+	}
+
+	if *replication != "" {
+		writeCluster, readCluster, ok := strings.Cut(*replication, ",")
+		if !ok || writeCluster == readCluster {
+			log.Fatalf("--replication must be WRITE_CLUSTER,READ_CLUSTER with two different clusters, got %q", *replication)
+		}
+		opts, err := bigtableClientOptions(ctx, cfg)
+		if err != nil {
+			log.Fatalf("Failed to resolve credentials: %v", err)
+		}
+		iac, err := bigtable.NewInstanceAdminClient(ctx, cfg.ProjectID, opts...)
+		if err != nil {
+			log.Fatalf("Failed to create instance admin client: %v", err)
+		}
+		defer iac.Close()
+
+		tables := make([]*bigtable.Table, 2)
+		for i, cluster := range []string{writeCluster, readCluster} {
+			profile := "single-" + cluster
+			if err := ensureSingleClusterProfile(ctx, iac, cfg.InstanceID, profile, cluster); err != nil {
+				log.Fatalf("Failed to set up app profile: %v", err)
+			}
+			c, err := createProfileClient(ctx, cfg, profile)
+			if err != nil {
+				log.Fatalf("Failed to create client: %v", err)
+			}
+			defer c.Close()
+			tables[i] = c.Open(cfg.TableID)
+		}
+
+		lag, err := measureReplicationLag(ctx, tables[0], tables[1], cfg, time.Minute)
+		if err != nil {
+			log.Fatalf("Failed to measure replication lag: %v", err)
+		}
+		fmt.Printf("Write to %s was readable from %s after %v\n", writeCluster, readCluster, lag)
+		return
+	}
+
+	if *backupID != "" {
+		if *clusterID == "" {
+			log.Fatal("--backup requires --cluster")
+		}
+		admin := createAdminClient(ctx, cfg)
+		defer admin.Close()
+
+		if *restoreTo != "" {
+			if err := restoreBackup(ctx, admin, *clusterID, *backupID, *restoreTo); err != nil {
+				log.Fatalf("Failed to restore backup: %v", err)
+			}
+			fmt.Println("Restored table:", *restoreTo)
+			return
+		}
+
+		info, err := createBackup(ctx, admin, cfg, *clusterID, *backupID, 7*24*time.Hour)
+		if err != nil {
+			log.Fatalf("Failed to create backup: %v", err)
+		}
+		fmt.Printf("Backup %s: state=%s size=%d bytes expires=%s\n",
+			info.Name, info.State, info.SizeBytes, info.ExpireTime.Format(time.RFC3339))
+		return
+	}
+
+	tbl := client.Open(cfg.TableID)
+
+	if *amplification != "" {
+		const threshold = 27.0
+		hot := func(rd Reading) bool { return rd.TempC.Valid && rd.TempC.Float64 > threshold }
+		serverSide, err := tempAboveFilter(cfg.ColumnFamily, threshold)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, c := range []struct {
+			name   string
+			filter bigtable.Filter
+		}{
+			{"no filter (every version)", nil},
+			{"latest version only", bigtable.LatestNFilter(1)},
+			{"server-side temp_c filter", serverSide},
+		} {
+			amp, err := measureReadAmplification(ctx, tbl, cfg, *amplification, c.filter, hot)
+			if err != nil {
+				log.Fatalf("Failed to measure %s: %v", c.name, err)
+			}
+			fmt.Printf("%-26s rows %d/%d, bytes %d/%d (read/matched), amplification %.1fx\n",
+				c.name, amp.RowsRead, amp.RowsMatched, amp.BytesRead, amp.BytesMatched, amp.Factor())
+		}
+		return
+	}
+
+	if *keysPrefix != "" {
+		keys, err := scanKeys(ctx, tbl, bigtable.PrefixRange(*keysPrefix))
+		if err != nil {
+			log.Fatalf("Failed to scan keys: %v", err)
+		}
+		for _, k := range keys {
+			fmt.Println(k)
+		}
+		fmt.Printf("%d rows under %q\n", len(keys), *keysPrefix)
+		return
+	}
+
+	if *devices > 0 {
+		ids, err := listDevices(ctx, tbl, cfg, *devices)
+		if err != nil {
+			log.Fatalf("Failed to list devices: %v", err)
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return
+	}
+
+	if *staleAfter > 0 {
+		stale, err := staleDevices(ctx, tbl, cfg, *staleAfter, time.Now())
+		if err != nil {
+			log.Fatalf("Failed to check for stale devices: %v", err)
+		}
+		for _, d := range stale {
+			log.Printf("stale device %s: last reading %s (%s ago)",
+				d.DeviceID, d.LastSeen.Format(time.RFC3339), d.Age.Round(time.Second))
+		}
+		if len(stale) > 0 {
+			// Non-zero so a cron job or health check can alert on it.
+			os.Exit(1)
+		}
+		fmt.Println("No stale devices")
+		return
+	}
+
+	if *ttlDemo > 0 {
+		admin := createAdminClient(ctx, cfg)
+		defer admin.Close()
+		if err := ttl.SetFamily(ctx, admin, cfg.TableID, ttlFamily, *ttlDemo); err != nil {
+			log.Fatalf("Failed to set TTL: %v", err)
+		}
+
+		ttlCfg := cfg
+		ttlCfg.ColumnFamily = ttlFamily
+		id := device.MustNewID("ttl-sensor")
+		rd := Reading{DeviceID: id, Timestamp: time.Now(), TempC: NullFloat64{Float64: 21.5, Valid: true}}
+		if err := writeRows(ctx, tbl, ttlCfg, []Reading{rd}, WriteOptions{}); err != nil {
+			log.Fatalf("Failed to write expiring reading: %v", err)
+		}
+
+		prefix := cfg.keys().Prefix(id)
+		live, err := scanRange(ctx, tbl, cfg.keys(), prefix, prefixSuccessor(prefix), ttl.LiveCellsFilter(*ttlDemo))
+		if err != nil {
+			log.Fatalf("Failed to read live cells: %v", err)
+		}
+		fmt.Printf("Wrote reading with %v TTL; %d live row(s)\n", *ttlDemo, len(live))
+
+		if err := ttl.WaitExpired(ctx, tbl, prefix, ttlFamily, *ttlDemo+30*time.Second); err != nil {
+			log.Fatalf("Reading did not expire: %v", err)
+		}
+		fmt.Println("Reading expired")
+		return
+	}
+
+	if *exportTo != "" {
+		datasetID, tableID, ok := strings.Cut(*exportTo, ".")
+		if !ok {
+			log.Fatalf("--export-bq must be dataset.table, got %q", *exportTo)
+		}
+		opts, err := gcpauth.ClientOptions(ctx, cfg.Auth)
+		if err != nil {
+			log.Fatalf("Failed to resolve credentials: %v", err)
+		}
+		bq, err := bigquery.NewClient(ctx, cfg.ProjectID, opts...)
+		if err != nil {
+			log.Fatalf("Failed to create BigQuery client: %v", err)
+		}
+		defer bq.Close()
 
-	scanRows(ctx, tbl, "sensor-42#")
+		sink := newBigQuerySink(ctx, bq, datasetID, tableID)
+		truncated, err := scanRows(ctx, tbl, cfg, cfg.keys().Prefix(device.MustNewID("sensor-42")), ScanOptions{}, sink)
+		if err == nil {
+			err = sink.Close()
+		}
+		if err != nil {
+			log.Fatalf("Failed to export readings: %v", err)
+		}
+		if truncated {
+			fmt.Printf("Export stopped at %d rows; set BIG_TABLE_MAX_ROWS to send more\n", cfg.rowLimit(0))
+		}
+		fmt.Printf("Exported sensor-42 readings to %s\n", *exportTo)
+		return
+	}
+
+	if *reconcileWith != "" {
+		opts, err := gcpauth.ClientOptions(ctx, cfg.Auth)
+		if err != nil {
+			log.Fatalf("Failed to resolve credentials: %v", err)
+		}
+		bq, err := bigquery.NewClient(ctx, cfg.ProjectID, opts...)
+		if err != nil {
+			log.Fatalf("Failed to create BigQuery client: %v", err)
+		}
+		defer bq.Close()
+
+		// Skip the last 5 minutes so in-flight dual writes aren't flagged.
+		until := time.Now().Add(-5 * time.Minute)
+		mismatches, err := reconcile(ctx, tbl, cfg.keys(), bq, *reconcileWith, until.Add(-24*time.Hour), until)
+		if err != nil {
+			log.Fatalf("Failed to reconcile: %v", err)
+		}
+		for _, m := range mismatches {
+			fmt.Printf("Device %s: Bigtable=%d BigQuery=%d\n", m.DeviceID, m.Bigtable, m.BigQuery)
+		}
+		fmt.Printf("%d devices differ\n", len(mismatches))
+		return
+	}
+
+	if *overviewFrom != "" {
+		opts, err := gcpauth.ClientOptions(ctx, cfg.Auth)
+		if err != nil {
+			log.Fatalf("Failed to resolve credentials: %v", err)
+		}
+		bq, err := bigquery.NewClient(ctx, cfg.ProjectID, opts...)
+		if err != nil {
+			log.Fatalf("Failed to create BigQuery client: %v", err)
+		}
+		defer bq.Close()
+
+		views, err := deviceOverview(ctx, tbl, cfg, bq, *overviewFrom, time.Now().Add(-24*time.Hour))
+		if err != nil {
+			log.Fatalf("Failed to build overview: %v", err)
+		}
+		for _, v := range views {
+			latest := "no Bigtable rows"
+			if v.Latest != nil {
+				latest = fmt.Sprintf("@%s temp=%s", v.Latest.Timestamp.Format(time.RFC3339), v.Latest.TempC)
+			}
+			fmt.Printf("Device %s: latest %s, BigQuery events=%d avg_temp=%s\n", v.DeviceID, latest, v.Events, v.AvgTemp)
+		}
+		return
+	}
+
+	if *replayFrom != "" {
+		opts, err := gcpauth.ClientOptions(ctx, cfg.Auth)
+		if err != nil {
+			log.Fatalf("Failed to resolve credentials: %v", err)
+		}
+		bq, err := bigquery.NewClient(ctx, cfg.ProjectID, opts...)
+		if err != nil {
+			log.Fatalf("Failed to create BigQuery client: %v", err)
+		}
+		defer bq.Close()
+
+		since := time.Now().Add(-*replaySince)
+		n, err := replayToBigtable(ctx, bq, *replayFrom, tbl, cfg, since)
+		fmt.Printf("Replayed %d readings since %s from %s\n", n, since.Format(time.RFC3339), *replayFrom)
+		if err != nil {
+			log.Fatalf("Replay had failures:\n%v", err)
+		}
+		return
+	}
+
+	if *backfill != "" {
+		n, err := backfillFromCSV(ctx, tbl, cfg, *backfill)
+		fmt.Printf("Backfilled %d readings from %s\n", n, *backfill)
+		if err != nil {
+			log.Fatalf("Backfill had failures:\n%v", err)
+		}
+		return
+	}
+
+	if *asOf != "" {
+		key, at, ok := strings.Cut(*asOf, "@")
+		if !ok {
+			log.Fatalf("--as-of must be KEY@TIME, got %q", *asOf)
+		}
+		t, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			log.Fatalf("--as-of: %v", err)
+		}
+		rd, err := readAsOf(ctx, tbl, cfg.keys(), key, t)
+		if err != nil {
+			log.Fatalf("Failed to read row as of %s: %v", at, err)
+		}
+		fmt.Printf("Reading as of %s: %s temp=%s hum=%s\n", at, rd.Key, rd.TempC, rd.HumidityPct)
+		return
+	}
+
+	if *deleteID != "" {
+		id, err := device.NewID(*deleteID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *dropRange {
+			admin := createAdminClient(ctx, cfg)
+			defer admin.Close()
+			if err := dropDevice(ctx, admin, cfg, id); err != nil {
+				log.Fatalf("Failed to drop device: %v", err)
+			}
+			fmt.Printf("Dropped all rows of %s\n", id)
+			return
+		}
+		n, err := deleteDevice(ctx, tbl, cfg, id)
+		fmt.Printf("Deleted %d rows of %s\n", n, id)
+		if err != nil {
+			log.Fatalf("Failed to delete device: %v", err)
+		}
+		return
+	}
+
+	if *stateTable != "" {
+		admin := createAdminClient(ctx, cfg)
+		defer admin.Close()
+		if err := admin.CreateTable(ctx, *stateTable); err != nil && status.Code(err) != codes.AlreadyExists {
+			log.Fatalf("Failed to create state table: %v", err)
+		}
+		if err := ensureStateFamily(ctx, admin, *stateTable); err != nil {
+			log.Fatalf("Failed to create state family: %v", err)
+		}
+
+		state := client.Open(*stateTable)
+		sensor := device.MustNewID("sensor-42")
+		now := time.Now()
+		// The later reading arrives first; the earlier one must not replace it.
+		for _, rd := range []Reading{
+			{DeviceID: sensor, Timestamp: now, TempC: NullFloat64{Float64: 27.4, Valid: true}, HumidityPct: NullFloat64{Float64: 61, Valid: true}},
+			{DeviceID: sensor, Timestamp: now.Add(-time.Minute), TempC: NullFloat64{Float64: 26.9, Valid: true}},
+		} {
+			if err := upsertReadings(ctx, state, cfg, []Reading{rd}); err != nil {
+				log.Fatalf("Failed to upsert readings: %v", err)
+			}
+		}
+		rd, err := readCurrentState(ctx, state, sensor)
+		if err != nil {
+			log.Fatalf("Failed to read current state: %v", err)
+		}
+		fmt.Printf("Current state of %s @%s: temp=%s hum=%s\n",
+			rd.DeviceID, rd.Timestamp.Format(time.RFC3339), rd.TempC, rd.HumidityPct)
+		return
+	}
+
+	if *countTo != "" {
+		// Counters live in their own table: rows keyed by bare device ID
+		// would not decode as readings in the events table.
+		admin := createAdminClient(ctx, cfg)
+		defer admin.Close()
+		if err := admin.CreateTable(ctx, *countTo); err != nil && status.Code(err) != codes.AlreadyExists {
+			log.Fatalf("Failed to create counter table: %v", err)
+		}
+		if err := ensureSumFamily(ctx, admin, *countTo, counterFamily); err != nil {
+			log.Fatalf("Failed to create sum family: %v", err)
+		}
+
+		counters := client.Open(*countTo)
+		key := string(device.MustNewID("sensor-42"))
+		day := time.Now().UTC().Truncate(24 * time.Hour)
+		for i := 0; i < 3; i++ {
+			if err := addToCounters(ctx, counters, key, map[string]int64{"events": 1, "bytes": 120}, day); err != nil {
+				log.Fatalf("Failed to add to counters: %v", err)
+			}
+		}
+		totals, err := readCounters(ctx, counters, key)
+		if err != nil {
+			log.Fatalf("Failed to read counters: %v", err)
+		}
+		fmt.Printf("Counters for %s: events=%d bytes=%d\n", key, totals["events"], totals["bytes"])
+		return
+	}
+
+	if *copyTo != "" {
+		stats, err := copyRows(ctx, tbl, client.Open(*copyTo), bigtable.InfiniteRange(""), nil)
+		fmt.Printf("Copied %d rows (%d cells) from %s to %s, %d failed\n", stats.Rows, stats.Cells, cfg.TableID, *copyTo, stats.Failed)
+		if err != nil {
+			log.Fatalf("Failed to copy rows: %v", err)
+		}
+		return
+	}
+
+	if *keyRange != "" {
+		start, end, ok := strings.Cut(*keyRange, ",")
+		if !ok {
+			log.Fatalf("--range must be START,END, got %q", *keyRange)
+		}
+		readings, err := scanRange(ctx, tbl, cfg.keys(), start, end, bigtable.LatestNFilter(1))
+		if err != nil {
+			log.Fatalf("Failed to scan range: %v", err)
+		}
+		for _, rd := range readings {
+			fmt.Printf("Reading: %s @%s temp=%s hum=%s\n",
+				rd.DeviceID, rd.Timestamp.Format(time.RFC3339), rd.TempC, rd.HumidityPct)
+		}
+		return
+	}
+
+	// Run operations
+	var attrs map[string]string
+	if *attrsFlag != "" {
+		if attrs, err = parseAttrs(*attrsFlag); err != nil {
+			log.Fatalf("Invalid --attrs: %v", err)
+		}
+		admin := createAdminClient(ctx, cfg)
+		err := ensureFamily(ctx, admin, cfg.TableID, attrFamily)
+		admin.Close()
+		if err != nil {
+			log.Fatalf("Failed to create attribute family: %v", err)
+		}
+	}
+
+	sensor := device.MustNewID("sensor-42")
+	rowKey := writeRow(ctx, tbl, cfg, sensor, attrs, writeOpts)
+
+	now := time.Now()
+	batch := []Reading{
+		{
+			DeviceID:    sensor,
+			Timestamp:   now.Add(-2 * time.Minute),
+			TempC:       NullFloat64{Float64: 26.9, Valid: true},
+			HumidityPct: NullFloat64{Float64: 63, Valid: true},
+			Attrs:       attrs,
+		},
+		{
+			DeviceID:    sensor,
+			Timestamp:   now.Add(-1 * time.Minute),
+			TempC:       NullFloat64{Float64: 27.1, Valid: true},
+			HumidityPct: NullFloat64{}, // humidity sensor offline: stored as absent
+			Attrs:       attrs,
+		},
+	}
+	written := len(batch)
+	if err := writeRows(ctx, tbl, cfg, batch, writeOpts); err != nil {
+		// Skewed readings alone are a data problem to report, not a failure.
+		var skewErr *SkewError
+		joined, ok := err.(interface{ Unwrap() []error })
+		if !errors.As(err, &skewErr) || !ok || len(joined.Unwrap()) > 1 {
+			log.Fatalf("Failed to write rows: %v", err)
+		}
+		fmt.Println("Warning:", skewErr)
+		for _, rd := range skewErr.Readings {
+			fmt.Printf("  %s @%s\n", rd.DeviceID, rd.Timestamp.Format(time.RFC3339))
+		}
+		if !skewErr.Clamped {
+			written -= len(skewErr.Readings)
+		}
+	}
+	fmt.Printf("Wrote %d rows in bulk\n", written)
+
+	if *versions > 0 {
+		if err := printRowVersions(ctx, tbl, rowKey, *versions, os.Stdout); err != nil {
+			log.Fatalf("Failed to read row versions: %v", err)
+		}
+	} else if err := readRow(ctx, tbl, rowKey, os.Stdout); err != nil {
+		log.Fatalf("Failed to read row: %v", err)
+	}
+
+	if *firstLast {
+		// Correct the sample row's temperature, then read both versions.
+		_, written, err := cfg.keys().Decode(rowKey)
+		if err != nil {
+			log.Fatalf("Failed to decode row key: %v", err)
+		}
+		fix := bigtable.NewMutation()
+		fix.Set(cfg.ColumnFamily, "temp_c", bigtable.Now(), []byte("27.9"))
+		if err := applyThrottled(ctx, tbl, rowKey, fix); err != nil {
+			log.Fatalf("Failed to correct row: %v", err)
+		}
+		fl, err := readFirstLast(ctx, tbl, cfg.keys(), rowKey, written.Add(time.Millisecond))
+		if err != nil {
+			log.Fatalf("Failed to read first and last versions: %v", err)
+		}
+		fmt.Printf("First: temp=%s hum=%s\nLast:  temp=%s hum=%s\n",
+			fl.First.TempC, fl.First.HumidityPct, fl.Last.TempC, fl.Last.HumidityPct)
+	}
+
+	if *alertAbove > 0 {
+		admin := createAdminClient(ctx, cfg)
+		defer admin.Close()
+		if err := ttl.SetFamily(ctx, admin, cfg.TableID, alertFamily, alertTTL); err != nil {
+			log.Fatalf("Failed to set alert TTL: %v", err)
+		}
+		fired, err := flagHighTemp(ctx, tbl, cfg, rowKey, *alertAbove)
+		if err != nil {
+			log.Fatalf("Failed to check alert: %v", err)
+		}
+		fmt.Printf("Temperature above %v: alert set: %t\n", *alertAbove, fired)
+	}
+
+	filter := columnValueRangeFilter(cfg.ColumnFamily, "temp_c", []byte("20"), []byte("30"))
+	cells, err := readFiltered(ctx, tbl, rowKey, filter)
+	if err != nil {
+		log.Fatalf("Failed to read filtered row: %v", err)
+	}
+	fmt.Printf("Cells with 20 <= temp_c < 30: %d\n", len(cells))
+
+	prefix := cfg.keys().Prefix(sensor)
+	fmt.Println("Scanning rows with prefix:", prefix)
+	scanned := &sliceSink{}
+	truncated, err := scanRows(ctx, tbl, cfg, prefix, ScanOptions{
+		MaxCellsPerRow:   *maxCells,
+		RowSizeThreshold: 1024,
+		OnLargeRow: func(key string, size int) {
+			fmt.Printf("Large row: %s (%d bytes)\n", key, size)
+		},
+	}, scanned)
+	if err != nil {
+		log.Fatalf("Failed to scan rows: %v", err)
+	}
+	for _, rd := range scanned.Readings {
+		if rd.Truncated {
+			fmt.Println("Row:", rd.Key, "(cells truncated)")
+			continue
+		}
+		fmt.Println("Row:", rd.Key)
+	}
+	if truncated {
+		fmt.Printf("Scan truncated at %d rows; set BIG_TABLE_MAX_ROWS to read more\n", cfg.rowLimit(0))
+	}
+
+	err = scanRowsFunc(ctx, tbl, cfg.keys(), bigtable.PrefixRange(prefix), bigtable.LatestNFilter(1),
+		func(rd Reading) error {
+			fmt.Printf("Reading: %s @%s temp=%s hum=%s",
+				rd.DeviceID, rd.Timestamp.Format(time.RFC3339), rd.TempC, rd.HumidityPct)
+			if len(rd.Attrs) > 0 {
+				fmt.Printf(" attrs=%v", rd.Attrs)
+			}
+			fmt.Println()
+			return nil
+		})
+	if err != nil {
+		log.Fatalf("Failed to scan readings: %v", err)
+	}
+
+	// Best-effort read for a dashboard: whatever arrives within the budget.
+	budgetCtx, cancel := context.WithTimeout(ctx, *scanBudget)
+	partial, truncated, err := scanRowsPartial(budgetCtx, tbl, cfg.keys(), prefix)
+	cancel()
+	if err != nil {
+		log.Fatalf("Failed to scan within budget: %v", err)
+	}
+	fmt.Printf("Scanned %d readings within %v (truncated: %t)\n", len(partial), *scanBudget, truncated)
+
+	resumed := 0
+	err = scanPrefixResumable(ctx, tbl, cfg.keys(), prefix, bigtable.LatestNFilter(1), 3, 30*time.Second,
+		func(Reading) error {
+			resumed++
+			return nil
+		})
+	if err != nil {
+		log.Fatalf("Failed to scan with resumption: %v", err)
+	}
+	fmt.Printf("Scanned %d readings with resumption\n", resumed)
+
+	summary, err := summarizeTemps(ctx, tbl, cfg.keys(), sensor, time.Now().Add(-time.Hour), time.Now())
+	if err != nil {
+		log.Fatalf("Failed to summarize temperatures: %v", err)
+	}
+	fmt.Printf("Last hour: %d readings, min=%.1f max=%.1f mean=%.2f (skipped %d cells)\n",
+		summary.Count, summary.Min, summary.Max, summary.Mean, summary.SkippedCells)
+
+	readings, errc := streamRows(ctx, tbl, cfg.keys(), bigtable.PrefixRange(prefix), bigtable.LatestNFilter(1))
+	streamed := 0
+	for range readings {
+		streamed++
+	}
+	if err := <-errc; err != nil {
+		log.Fatalf("Failed to stream readings: %v", err)
+	}
+	fmt.Printf("Streamed %d readings\n", streamed)
+
+	if *ingest > 0 {
+		pool := newIngestPool(ctx, tbl, cfg, writeOpts, IngestConfig{})
+		start := time.Now()
+		for i := 0; i < *ingest; i++ {
+			rd := Reading{
+				DeviceID:    device.MustNewID(fmt.Sprintf("sensor-%d", i%10)),
+				Timestamp:   start.Add(-time.Duration(i) * time.Millisecond),
+				TempC:       NullFloat64{Float64: 20 + float64(i%100)/10, Valid: true},
+				HumidityPct: NullFloat64{Float64: 50, Valid: true},
+			}
+			if err := pool.Add(ctx, rd); err != nil {
+				log.Fatalf("Failed to queue reading: %v", err)
+			}
+		}
+		if err := pool.Close(); err != nil {
+			log.Fatalf("Ingest failed: %v", err)
+		}
+		fmt.Printf("Ingested %d readings in %v\n", *ingest, time.Since(start))
+	}
+
+	// At-most-once write: the second attempt with the same key is a no-op.
+	rd := Reading{DeviceID: sensor, Timestamp: time.Now(), TempC: NullFloat64{Float64: 27.0, Valid: true}}
+	onceKey, err := rowkey.Unique(cfg.keys(), rd.DeviceID, rd.Timestamp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for attempt := 1; attempt <= 2; attempt++ {
+		applied, err := writeRowIfAbsent(ctx, tbl, cfg, onceKey, rd, writeOpts)
+		if err != nil {
+			log.Fatalf("Failed to write row once: %v", err)
+		}
+		fmt.Printf("Attempt %d wrote %s: %t\n", attempt, onceKey, applied)
+	}
+
+	// Optional: dump the device's rows as JSON lines when BIG_TABLE_EXPORT_JSONL=1
+	if os.Getenv("BIG_TABLE_EXPORT_JSONL") == "1" {
+		n, err := exportJSONL(ctx, tbl, cfg.keys(), prefix, os.Stdout)
+		if err != nil {
+			log.Fatalf("Failed to export rows: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d rows\n", n)
+	}
+
+	audit, err := appendCell(ctx, tbl, cfg, sensor, "audit", []byte("read;"))
+	if err != nil {
+		log.Fatalf("Failed to append audit cell: %v", err)
+	}
+	fmt.Println("Audit trail:", string(audit))
 }
@@ -0,0 +1,154 @@
+// Package gcpauth chooses the credentials used by the example clients.
+//
+// By default the Google Cloud clients use Application Default Credentials
+// (ADC). Outside GCP it is often easier to point at a service-account key
+// file or to impersonate a service account, so both are supported here with
+// ADC as the fallback.
+//
+// Impersonation is the least-privilege option: the source identity (a
+// developer's ADC, say) holds only roles/iam.serviceAccountTokenCreator on
+// the target, and the clients run with short-lived tokens for the target's
+// narrower roles, refreshed hourly. No key file is involved.
+package gcpauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// ErrNoCredentials is wrapped by the ClientOptions error when no credentials
+// are configured and ADC finds none, so callers can tell "not logged in"
+// apart from credentials that are set but broken.
+var ErrNoCredentials = errors.New("no credentials found")
+
+// Config selects how clients authenticate. The zero value means ADC.
+type Config struct {
+	// CredentialsFile is the path to a service-account JSON key.
+	CredentialsFile string
+
+	// ImpersonateServiceAccount is the email of a service account to
+	// impersonate, using CredentialsFile or ADC as the source identity.
+	ImpersonateServiceAccount string
+
+	// ImpersonateDelegates is an optional delegation chain: the source
+	// identity impersonates the first, each one the next, and the last
+	// ImpersonateServiceAccount. Each needs Token Creator on the next.
+	ImpersonateDelegates []string
+}
+
+// FromEnv reads CREDENTIALS_FILE, IMPERSONATE_SERVICE_ACCOUNT and
+// IMPERSONATE_DELEGATES (comma-separated).
+func FromEnv() Config {
+	cfg := Config{
+		CredentialsFile:           os.Getenv("CREDENTIALS_FILE"),
+		ImpersonateServiceAccount: os.Getenv("IMPERSONATE_SERVICE_ACCOUNT"),
+	}
+	if v := os.Getenv("IMPERSONATE_DELEGATES"); v != "" {
+		for _, sa := range strings.Split(v, ",") {
+			cfg.ImpersonateDelegates = append(cfg.ImpersonateDelegates, strings.TrimSpace(sa))
+		}
+	}
+	return cfg
+}
+
+// Validate checks the settings without contacting Google: that the key file
+// exists and that the impersonation target looks like a service account.
+// Every problem is reported, joined into one error.
+func (c Config) Validate() error {
+	var errs []error
+	if c.CredentialsFile != "" {
+		if fi, err := os.Stat(c.CredentialsFile); err != nil {
+			errs = append(errs, fmt.Errorf("CREDENTIALS_FILE: %w", err))
+		} else if fi.IsDir() {
+			errs = append(errs, fmt.Errorf("CREDENTIALS_FILE %s is a directory", c.CredentialsFile))
+		}
+	}
+	if sa := c.ImpersonateServiceAccount; sa != "" && !strings.Contains(sa, "@") {
+		errs = append(errs, fmt.Errorf("IMPERSONATE_SERVICE_ACCOUNT %q is not a service account email", sa))
+	}
+	if len(c.ImpersonateDelegates) > 0 && c.ImpersonateServiceAccount == "" {
+		errs = append(errs, errors.New("IMPERSONATE_DELEGATES is set without IMPERSONATE_SERVICE_ACCOUNT"))
+	}
+	for _, sa := range c.ImpersonateDelegates {
+		if !strings.Contains(sa, "@") {
+			errs = append(errs, fmt.Errorf("IMPERSONATE_DELEGATES entry %q is not a service account email", sa))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ClientOptions returns the client options for cfg. With neither field set
+// it verifies that ADC can be found, so a missing login fails with a clear
+// message at startup instead of on the first RPC.
+//
+// Without scopes each client keeps its defaults, which cover the Cloud APIs.
+// Workspace APIs such as Sheets need scopes passed explicitly; note that
+// user ADC only carries them if granted at login
+// (gcloud auth application-default login --scopes=...).
+func ClientOptions(ctx context.Context, cfg Config, scopes ...string) ([]option.ClientOption, error) {
+	wantScopes := scopes
+	if len(wantScopes) == 0 {
+		wantScopes = []string{cloudPlatformScope}
+	}
+
+	var source []option.ClientOption
+	if cfg.CredentialsFile != "" {
+		if _, err := os.Stat(cfg.CredentialsFile); err != nil {
+			return nil, fmt.Errorf("credentials file: %w", err)
+		}
+		source = append(source, option.WithCredentialsFile(cfg.CredentialsFile))
+	} else if _, err := google.FindDefaultCredentials(ctx, wantScopes...); err != nil {
+		return nil, fmt.Errorf("%w: set CREDENTIALS_FILE, run "+
+			"`gcloud auth application-default login`, or run on GCP: %w", ErrNoCredentials, err)
+	}
+
+	if cfg.ImpersonateServiceAccount != "" {
+		// The source identity only calls the IAM Credentials API; the
+		// requested scopes go on the impersonated token.
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: cfg.ImpersonateServiceAccount,
+			Scopes:          wantScopes,
+			Delegates:       cfg.ImpersonateDelegates,
+		}, source...)
+		if err != nil {
+			return nil, fmt.Errorf("impersonate %s: %w", cfg.ImpersonateServiceAccount, err)
+		}
+		// Tokens are otherwise fetched on the first RPC, where a missing
+		// grant surfaces as an obscure transport error; fetch one now.
+		if _, err := ts.Token(); err != nil {
+			return nil, impersonationError(cfg.ImpersonateServiceAccount, err)
+		}
+		return []option.ClientOption{option.WithTokenSource(ts)}, nil
+	}
+
+	if len(scopes) > 0 {
+		source = append(source, option.WithScopes(scopes...))
+	}
+	return source, nil
+}
+
+// impersonationError explains the usual causes of a failed token request.
+// The impersonate package reports HTTP failures only as text, so the
+// status is matched in the message.
+func impersonationError(target string, err error) error {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "status code 403"):
+		return fmt.Errorf("impersonate %s: permission denied: the source identity needs "+
+			"roles/iam.serviceAccountTokenCreator on it (on the first delegate when "+
+			"IMPERSONATE_DELEGATES is set), and the IAM Service Account Credentials API "+
+			"must be enabled: %w", target, err)
+	case strings.Contains(msg, "status code 404"):
+		return fmt.Errorf("impersonate %s: service account not found: %w", target, err)
+	}
+	return fmt.Errorf("impersonate %s: %w", target, err)
+}
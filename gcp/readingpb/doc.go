@@ -0,0 +1,13 @@
+// Package readingpb is the protobuf encoding of a sensor reading's metrics,
+// used by the Bigtable example to store them as one compact binary cell.
+//
+// reading.pb.go is generated from reading.proto; after editing the schema,
+// regenerate it with protoc and protoc-gen-go on the PATH:
+//
+//	go generate ./readingpb
+//
+// Only ever add fields, with new numbers: cells already written keep the
+// old numbering, and unknown fields are skipped when decoding.
+package readingpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative reading.proto
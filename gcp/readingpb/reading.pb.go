@@ -0,0 +1,140 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.7
+// 	protoc        (unknown)
+// source: reading.proto
+
+package readingpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Reading holds a sensor row's metrics as one Bigtable cell. The device ID
+// and timestamp live in the row key and attributes in their own family, so
+// neither is repeated here.
+type Reading struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Temperature in degrees Celsius; unset when the sensor sent none.
+	TempC *float64 `protobuf:"fixed64,1,opt,name=temp_c,json=tempC,proto3,oneof" json:"temp_c,omitempty"`
+	// Relative humidity in percent; unset when the sensor sent none.
+	HumPct        *float64 `protobuf:"fixed64,2,opt,name=hum_pct,json=humPct,proto3,oneof" json:"hum_pct,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Reading) Reset() {
+	*x = Reading{}
+	mi := &file_reading_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Reading) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Reading) ProtoMessage() {}
+
+func (x *Reading) ProtoReflect() protoreflect.Message {
+	mi := &file_reading_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Reading.ProtoReflect.Descriptor instead.
+func (*Reading) Descriptor() ([]byte, []int) {
+	return file_reading_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Reading) GetTempC() float64 {
+	if x != nil && x.TempC != nil {
+		return *x.TempC
+	}
+	return 0
+}
+
+func (x *Reading) GetHumPct() float64 {
+	if x != nil && x.HumPct != nil {
+		return *x.HumPct
+	}
+	return 0
+}
+
+var File_reading_proto protoreflect.FileDescriptor
+
+const file_reading_proto_rawDesc = "" +
+	"\n" +
+	"\rreading.proto\x12\x0etidy.readingpb\"Z\n" +
+	"\aReading\x12\x1a\n" +
+	"\x06temp_c\x18\x01 \x01(\x01H\x00R\x05tempC\x88\x01\x01\x12\x1c\n" +
+	"\ahum_pct\x18\x02 \x01(\x01H\x01R\x06humPct\x88\x01\x01B\t\n" +
+	"\a_temp_cB\n" +
+	"\n" +
+	"\b_hum_pctB\x10Z\x0etidy/readingpbb\x06proto3"
+
+var (
+	file_reading_proto_rawDescOnce sync.Once
+	file_reading_proto_rawDescData []byte
+)
+
+func file_reading_proto_rawDescGZIP() []byte {
+	file_reading_proto_rawDescOnce.Do(func() {
+		file_reading_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_reading_proto_rawDesc), len(file_reading_proto_rawDesc)))
+	})
+	return file_reading_proto_rawDescData
+}
+
+var file_reading_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_reading_proto_goTypes = []any{
+	(*Reading)(nil), // 0: tidy.readingpb.Reading
+}
+var file_reading_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_reading_proto_init() }
+func file_reading_proto_init() {
+	if File_reading_proto != nil {
+		return
+	}
+	file_reading_proto_msgTypes[0].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_reading_proto_rawDesc), len(file_reading_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_reading_proto_goTypes,
+		DependencyIndexes: file_reading_proto_depIdxs,
+		MessageInfos:      file_reading_proto_msgTypes,
+	}.Build()
+	File_reading_proto = out.File
+	file_reading_proto_goTypes = nil
+	file_reading_proto_depIdxs = nil
+}
@@ -0,0 +1,50 @@
+// Package retry classifies errors from the Google Cloud clients as transient
+// (worth retrying) or permanent.
+//
+// BigQuery's REST client reports failures as *googleapi.Error with an HTTP
+// status, while Bigtable's gRPC client uses status codes, so both are
+// handled here. Anything unrecognised is treated as permanent: retrying a
+// bad request forever is worse than failing fast.
+package retry
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Retryable reports whether err is a transient failure:
+//
+//   - HTTP 408, 429, 500, 502, 503 and 504 from googleapi
+//   - gRPC Unavailable, DeadlineExceeded, ResourceExhausted and Aborted
+//   - context.DeadlineExceeded from a per-attempt timeout
+//
+// context.Canceled and every other code, such as HTTP 400 or gRPC
+// InvalidArgument, are permanent. Callers must still stop retrying once
+// their parent context is done.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case 408, 429, 500, 502, 503, 504:
+			return true
+		}
+		return false
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package retry
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"googleapi 429", &googleapi.Error{Code: 429}, true},
+		{"googleapi 500", &googleapi.Error{Code: 500}, true},
+		{"googleapi 503", &googleapi.Error{Code: 503}, true},
+		{"googleapi 400", &googleapi.Error{Code: 400}, false},
+		{"grpc Unavailable", status.Error(codes.Unavailable, "unavailable"), true},
+		{"grpc DeadlineExceeded", status.Error(codes.DeadlineExceeded, "deadline"), true},
+		{"grpc InvalidArgument", status.Error(codes.InvalidArgument, "bad"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Retryable(tt.err); got != tt.want {
+				t.Errorf("Retryable(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+		t.Run(tt.name+" wrapped", func(t *testing.T) {
+			err := fmt.Errorf("op: %w", tt.err)
+			if got := Retryable(err); got != tt.want {
+				t.Errorf("Retryable(%v) = %t, want %t", err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Package rowkey lays out the Bigtable row keys of sensor readings.
+//
+// A key encodes the reading's device and time. Every layout keeps a
+// device's rows under one prefix, so they can be scanned with a prefix
+// range, but they differ in how those rows sort: newest first (Reversed),
+// oldest first (Forward), or behind a shard number that spreads devices
+// with similar IDs across the key space (Sharded). Use one layout per
+// table: the reversed and forward layouts share prefixes, and a scan
+// fails on the first row it cannot decode.
+package rowkey
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"tidy/device"
+)
+
+// Strategy maps a reading's device and time to a row key and back. Keys
+// of one device must share Prefix(deviceID).
+type Strategy interface {
+	Encode(deviceID device.ID, t time.Time) string
+	Decode(key string) (device.ID, time.Time, error)
+	Prefix(deviceID device.ID) string
+}
+
+// Reversed is deviceID#reversedMillis, the bitwise complement of the Unix
+// milliseconds: a device's newest readings sort first, so "latest N" is a
+// short forward scan, and writes don't hotspot on the end of the table.
+type Reversed struct{}
+
+func (Reversed) Encode(deviceID device.ID, t time.Time) string {
+	reversed := ^uint64(uint64(t.UnixMilli()))
+	return fmt.Sprintf("%s#%d", deviceID, reversed)
+}
+
+func (Reversed) Decode(key string) (device.ID, time.Time, error) {
+	deviceID, tsPart, err := split(key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	reversed, err := strconv.ParseUint(tsPart, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("row key %q: bad timestamp: %w", key, err)
+	}
+	return deviceID, time.UnixMilli(int64(^reversed)).UTC(), nil
+}
+
+func (Reversed) Prefix(deviceID device.ID) string { return string(deviceID) + "#" }
+
+// Forward is deviceID#millis, zero-padded so keys sort by time: oldest
+// first, which suits replaying a device's history in order.
+type Forward struct{}
+
+func (Forward) Encode(deviceID device.ID, t time.Time) string {
+	return fmt.Sprintf("%s#%020d", deviceID, t.UnixMilli())
+}
+
+func (Forward) Decode(key string) (device.ID, time.Time, error) {
+	deviceID, tsPart, err := split(key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	ms, err := strconv.ParseInt(tsPart, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("row key %q: bad timestamp: %w", key, err)
+	}
+	return deviceID, time.UnixMilli(ms).UTC(), nil
+}
+
+func (Forward) Prefix(deviceID device.ID) string { return string(deviceID) + "#" }
+
+// Sharded prefixes Inner's keys with a shard number derived from the
+// device ID, e.g. 03#sensor-42#.... Devices with similar IDs (sensor-0001,
+// sensor-0002, ...) otherwise sit next to each other and load one tablet;
+// the shard spreads them across Shards key ranges while each device's
+// rows stay contiguous. Changing Shards moves every device, so pick it once.
+type Sharded struct {
+	Shards int
+	Inner  Strategy
+}
+
+func (k Sharded) shard(deviceID device.ID) int {
+	h := fnv.New32a()
+	h.Write([]byte(deviceID))
+	return int(h.Sum32() % uint32(k.Shards))
+}
+
+func (k Sharded) Encode(deviceID device.ID, t time.Time) string {
+	return fmt.Sprintf("%02d#%s", k.shard(deviceID), k.Inner.Encode(deviceID, t))
+}
+
+func (k Sharded) Decode(key string) (device.ID, time.Time, error) {
+	_, rest, ok := strings.Cut(key, "#")
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("row key %q has no shard prefix", key)
+	}
+	return k.Inner.Decode(rest)
+}
+
+func (k Sharded) Prefix(deviceID device.ID) string {
+	return fmt.Sprintf("%02d#%s", k.shard(deviceID), k.Inner.Prefix(deviceID))
+}
+
+// DefaultShards is the shard count of "sharded" without an explicit N.
+const DefaultShards = 8
+
+// Parse parses a layout name: reversed, forward, or sharded[:N] (sharded
+// reversed keys, N shards).
+func Parse(s string) (Strategy, error) {
+	name, arg, hasArg := strings.Cut(s, ":")
+	switch {
+	case name == "reversed" && !hasArg:
+		return Reversed{}, nil
+	case name == "forward" && !hasArg:
+		return Forward{}, nil
+	case name == "sharded":
+		n := DefaultShards
+		if hasArg {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil || n < 1 || n > 100 {
+				return nil, fmt.Errorf("shard count must be 1-100, got %q", arg)
+			}
+		}
+		return Sharded{Shards: n, Inner: Reversed{}}, nil
+	}
+	return nil, fmt.Errorf("unknown key format %q (want reversed, forward or sharded[:N])", s)
+}
+
+// NewestFirst reports whether s sorts a device's rows newest first, so
+// the first row under its prefix is its latest.
+func NewestFirst(s Strategy) bool {
+	switch k := s.(type) {
+	case Forward:
+		return false
+	case Sharded:
+		return NewestFirst(k.Inner)
+	}
+	return true
+}
+
+// Unique returns s's key for a reading with a random suffix, so two
+// readings of the same device in the same millisecond don't collide.
+// Decode ignores the suffix.
+func Unique(s Strategy, deviceID device.ID, t time.Time) (string, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("rand.Read: %w", err)
+	}
+	return s.Encode(deviceID, t) + "#" + hex.EncodeToString(b[:]), nil
+}
+
+// Range returns the half-open key range [start, end) holding deviceID's
+// readings observed in [from, to], Unique suffixes included. With a
+// newest-first layout the newer bound gives the start key.
+func Range(s Strategy, deviceID device.ID, from, to time.Time) (start, end string) {
+	if NewestFirst(s) {
+		// from-1ms makes the exclusive end key include from's own rows.
+		return s.Encode(deviceID, to), s.Encode(deviceID, from.Add(-time.Millisecond))
+	}
+	return s.Encode(deviceID, from), s.Encode(deviceID, to.Add(time.Millisecond))
+}
+
+// Split deviceID#timestamp[#suffix] into the device ID and timestamp text
+func split(key string) (device.ID, string, error) {
+	rawID, rest, ok := strings.Cut(key, "#")
+	if !ok {
+		return "", "", fmt.Errorf("row key %q has no '#' separator", key)
+	}
+	deviceID, err := device.NewID(rawID)
+	if err != nil {
+		return "", "", fmt.Errorf("row key %q: %w", key, err)
+	}
+	tsPart, _, _ := strings.Cut(rest, "#")
+	return deviceID, tsPart, nil
+}
@@ -0,0 +1,97 @@
+package rowkey
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"tidy/device"
+)
+
+var strategies = []struct {
+	name string
+	s    Strategy
+}{
+	{"reversed", Reversed{}},
+	{"forward", Forward{}},
+	{"sharded", Sharded{Shards: DefaultShards, Inner: Reversed{}}},
+	{"sharded forward", Sharded{Shards: 3, Inner: Forward{}}},
+}
+
+func TestRoundTrip(t *testing.T) {
+	id := device.MustNewID("sensor-42")
+	ts := time.Date(2024, 5, 1, 12, 30, 45, 123_000_000, time.UTC)
+	for _, tt := range strategies {
+		t.Run(tt.name, func(t *testing.T) {
+			unique, err := Unique(tt.s, id, ts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{tt.s.Encode(id, ts), unique} {
+				if !strings.HasPrefix(key, tt.s.Prefix(id)) {
+					t.Errorf("key %q lacks prefix %q", key, tt.s.Prefix(id))
+				}
+				gotID, gotTS, err := tt.s.Decode(key)
+				if err != nil {
+					t.Fatalf("Decode(%q): %v", key, err)
+				}
+				if gotID != id || !gotTS.Equal(ts) {
+					t.Errorf("Decode(%q) = %s, %v; want %s, %v", key, gotID, gotTS, id, ts)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderAndRange(t *testing.T) {
+	id := device.MustNewID("sensor-42")
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range strategies {
+		t.Run(tt.name, func(t *testing.T) {
+			// Keys for base, base+1m, ..., base+4m.
+			var keys []string
+			for i := 0; i < 5; i++ {
+				keys = append(keys, tt.s.Encode(id, base.Add(time.Duration(i)*time.Minute)))
+			}
+			sorted := sort.StringsAreSorted(keys)
+			if newest := NewestFirst(tt.s); newest == sorted {
+				t.Errorf("NewestFirst = %t, but keys sort oldest first = %t", newest, sorted)
+			}
+
+			start, end := Range(tt.s, id, base.Add(time.Minute), base.Add(3*time.Minute))
+			for i, key := range keys {
+				in := start <= key && key < end
+				if want := i >= 1 && i <= 3; in != want {
+					t.Errorf("key for +%dm in [%q, %q) = %t, want %t", i, start, end, in, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Strategy
+		wantErr bool
+	}{
+		{in: "reversed", want: Reversed{}},
+		{in: "forward", want: Forward{}},
+		{in: "sharded", want: Sharded{Shards: DefaultShards, Inner: Reversed{}}},
+		{in: "sharded:16", want: Sharded{Shards: 16, Inner: Reversed{}}},
+		{in: "sharded:0", wantErr: true},
+		{in: "forward:2", wantErr: true},
+		{in: "random", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v, wantErr %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Package ttl expires Bigtable cells by age with max-age GC policies, and
+// hides or waits out expired cells, kept out of the Bigtable example so it
+// can be tested against the emulator.
+package ttl
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SetFamily creates family if needed and sets a max-age GC policy, so
+// cells whose timestamp is older than ttl become eligible for deletion.
+// Age is measured from each cell's timestamp, not the row key or write
+// time, which is why readings carry explicit timestamps: a backfilled cell
+// already older than ttl is collectable as soon as it is written.
+func SetFamily(ctx context.Context, admin *bigtable.AdminClient, tableID, family string, ttl time.Duration) error {
+	err := admin.CreateColumnFamily(ctx, tableID, family)
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("CreateColumnFamily %s: %w", family, err)
+	}
+	if err := admin.SetGCPolicy(ctx, tableID, family, bigtable.MaxAgePolicy(ttl)); err != nil {
+		return fmt.Errorf("SetGCPolicy %s: %w", family, err)
+	}
+	return nil
+}
+
+// LiveCellsFilter hides cells older than ttl. Production Bigtable collects
+// garbage lazily (it can take up to a week), so reads that must not see
+// expired data have to filter on the cell timestamp themselves.
+func LiveCellsFilter(ttl time.Duration) bigtable.Filter {
+	return bigtable.TimestampRangeFilter(time.Now().Add(-ttl), time.Time{})
+}
+
+// pollInterval is how often WaitExpired rescans the rows.
+const pollInterval = 500 * time.Millisecond
+
+// WaitExpired polls the rows under prefix until none has a cell left in
+// family, or returns an error once timeout passes. Against the emulator
+// (BIGTABLE_EMULATOR_HOST), which runs GC about every second, a tiny TTL
+// expires within a couple of seconds; on a real instance expect much longer.
+func WaitExpired(ctx context.Context, tbl *bigtable.Table, prefix, family string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := 0
+		err := tbl.ReadRows(ctx, bigtable.PrefixRange(prefix),
+			func(bigtable.Row) bool {
+				remaining++
+				return true
+			},
+			bigtable.RowFilter(bigtable.FamilyFilter(regexp.QuoteMeta(family))),
+		)
+		if err != nil {
+			return fmt.Errorf("tbl.ReadRows: %w", err)
+		}
+		if remaining == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d rows under %q still have %s cells after %v", remaining, prefix, family, timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package ttl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// TestMaxAgeExpires writes a cell to a family with a one-second max age
+// and expects the emulator's GC to remove it. It only runs against the
+// emulator: real instances collect garbage far too lazily for a test.
+func TestMaxAgeExpires(t *testing.T) {
+	if os.Getenv("BIGTABLE_EMULATOR_HOST") == "" {
+		t.Skip("BIGTABLE_EMULATOR_HOST not set")
+	}
+	ctx := context.Background()
+	const project, instance, family = "test-project", "test-instance", "ttl"
+	tableID := fmt.Sprintf("ttl-test-%d", time.Now().UnixNano())
+
+	admin, err := bigtable.NewAdminClient(ctx, project, instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if err := admin.CreateTable(ctx, tableID); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.DeleteTable(ctx, tableID)
+	if err := SetFamily(ctx, admin, tableID, family, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := bigtable.NewClient(ctx, project, instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	tbl := client.Open(tableID)
+
+	mut := bigtable.NewMutation()
+	mut.Set(family, "temp", bigtable.Now(), []byte("21.5"))
+	if err := tbl.Apply(ctx, "sensor#1", mut); err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := tbl.ReadRow(ctx, "sensor#1", bigtable.RowFilter(LiveCellsFilter(time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(row[family]) != 1 {
+		t.Fatalf("fresh cell not readable: got %v", row)
+	}
+
+	if err := WaitExpired(ctx, tbl, "sensor#", family, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}